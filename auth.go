@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Lifetime of server-issued session tokens.
+const tokenValidity = 24 * time.Hour
+
+// Key used to sign session tokens.
+var tokenKey []byte
+
+// The outcome of hashing or checking a request's password. bcrypt is too slow
+// to run in the request poller, so this is done by the client's connection
+// before the request is queued.
+type credentials struct {
+	hash    []byte // hash of the password, for set_name & first logins
+	matched []byte // stored hash which the password matched, for logins
+}
+
+// A request for the password hash stored for a user name. It is answered by
+// the request poller as only the poller accesses the store.
+type hashLookup struct {
+	name  string
+	reply chan []byte
+}
+
+var hashLookups = make(chan hashLookup)
+
+// Hash or check the password of a set_name or login request. Logins to users
+// with a stored hash are checked against it, otherwise the password is hashed
+// so it can be stored.
+func prepareCredentials(msg *Message) *credentials {
+	if (msg.Type != "set_name" && msg.Type != "login") || msg.Secret == "" {
+		return nil
+	}
+
+	creds := &credentials{}
+	var stored []byte
+	if msg.Type == "login" {
+		reply := make(chan []byte, 1)
+		hashLookups <- hashLookup{name: msg.Username, reply: reply}
+		stored = <-reply
+	}
+	if len(stored) > 0 {
+		if checkSecret(stored, msg.Secret) {
+			creds.matched = stored
+		}
+		return creds
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(msg.Secret), bcrypt.DefaultCost)
+	if err == nil {
+		creds.hash = hash
+	}
+	return creds
+}
+
+// Get the stored hash of the request's password. Journaled requests being
+// replayed already hold the hash in place of the password.
+func (req *MessageRequest) hashSecret(secret string) ([]byte, error) {
+	if req.replay {
+		return []byte(secret), nil
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("a password is required")
+	}
+	if req.creds == nil || req.creds.hash == nil {
+		return nil, fmt.Errorf("password could not be hashed")
+	}
+	return req.creds.hash, nil
+}
+
+// Check the request's password matched a user's stored hash.
+func (req *MessageRequest) secretMatches(hash []byte) bool {
+	return req.creds != nil && len(hash) > 0 && bytes.Equal(req.creds.matched, hash)
+}
+
+// Check a password against a stored hash.
+func checkSecret(hash []byte, secret string) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(secret)) == nil
+}
+
+// Read the token signing key from file, generating a new key file if one
+// does not exist.
+func loadTokenKey(filePath string) ([]byte, error) {
+	key, err := os.ReadFile(filePath)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(filePath, key, 0600)
+}
+
+// Issue a signed token identifying a user. Clients without a persistent
+// connection (UDP) send it with each request in place of logging in.
+func issueToken(userID UUID) string {
+	expiry := strconv.FormatInt(time.Now().Add(tokenValidity).Unix(), 10)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userID)) + "." + expiry
+	return payload + "." + signToken(payload)
+}
+
+// Verify a token's signature & expiry and return the user it identifies.
+func verifyToken(token string) (UUID, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(signToken(payload)), []byte(parts[2])) {
+		return "", fmt.Errorf("invalid token signature")
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", fmt.Errorf("token has expired")
+	}
+	userID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	return UUID(userID), nil
+}
+
+// Compute the signature of a token payload.
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a fixed token signing key for the duration of a test.
+func useTestTokenKey(t *testing.T) {
+	t.Helper()
+	previous := tokenKey
+	tokenKey = []byte("test signing key")
+	t.Cleanup(func() { tokenKey = previous })
+}
+
+func TestTokenIdentifiesUser(t *testing.T) {
+	useTestTokenKey(t)
+
+	userID, err := verifyToken(issueToken("user-1"))
+	if err != nil {
+		t.Fatalf("verifying token: %s", err)
+	}
+	if userID != "user-1" {
+		t.Fatalf("expected token for 'user-1', got '%s'", userID)
+	}
+}
+
+func TestTokenRejectsTampering(t *testing.T) {
+	useTestTokenKey(t)
+	token := issueToken("user-1")
+	parts := strings.Split(token, ".")
+
+	// claim to be another user with the original signature
+	forged := base64.RawURLEncoding.EncodeToString([]byte("user-2")) + "." + parts[1] + "." + parts[2]
+	if _, err := verifyToken(forged); err == nil {
+		t.Error("expected a token with a changed user to be rejected")
+	}
+
+	// extend the expiry with the original signature
+	extended := parts[0] + "." + strconv.FormatInt(time.Now().Add(365*24*time.Hour).Unix(), 10) + "." + parts[2]
+	if _, err := verifyToken(extended); err == nil {
+		t.Error("expected a token with a changed expiry to be rejected")
+	}
+
+	// a token signed with another key
+	tokenKey = []byte("another signing key")
+	if _, err := verifyToken(token); err == nil {
+		t.Error("expected a token signed with another key to be rejected")
+	}
+}
+
+func TestTokenRejectsExpired(t *testing.T) {
+	useTestTokenKey(t)
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte("user-1")) + "." + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	if _, err := verifyToken(payload + "." + signToken(payload)); err == nil {
+		t.Error("expected an expired token to be rejected")
+	}
+}
+
+func TestTokenRejectsMalformed(t *testing.T) {
+	useTestTokenKey(t)
+
+	for _, token := range []string{"", "abc", "a.b", "a.b.c.d"} {
+		if _, err := verifyToken(token); err == nil {
+			t.Errorf("expected malformed token '%s' to be rejected", token)
+		}
+	}
+}
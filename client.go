@@ -2,6 +2,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"os"
@@ -14,6 +15,8 @@ import (
 	"strconv"
 
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/twinj/uuid"
 )
@@ -28,10 +31,16 @@ type Client struct {
 	httpServer HTTPServer
 	protocol   string
 	conn       net.Conn
+	token      string
+	authMu     sync.Mutex
 }
 
 var uuidFilePath string
 
+// Interval between heartbeats sent by UDP clients, well within the server's
+// session timeout.
+const heartbeatInterval = time.Minute
+
 func NewClient(host string, port int) error {
 	// continuously process stdin console input
 	input := getConsoleInput("Protocol: tcp or udp (default tcp)")
@@ -46,7 +55,7 @@ func NewClient(host string, port int) error {
 // Start a new client instance.
 func (c *Client) Start() error {
 	// connect to server
-	conn, err := net.Dial(c.protocol, c.host+":"+strconv.Itoa(c.port))
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
@@ -57,11 +66,17 @@ func (c *Client) Start() error {
 	c.clientUUID = c.initUUID(conn)
 
 	// start HTTP server to access web UI
+	c.httpServer.events = newEventFeed()
 	go c.httpServer.Start(c)
 
 	// continuously read from connection
 	go c.readFromConnection(conn)
 
+	// UDP sessions expire on the server unless requests are made regularly
+	if c.protocol == "udp" {
+		go c.sendHeartbeats(conn)
+	}
+
 	// continuously process stdin console input
 	go func() {
 		for {
@@ -73,6 +88,16 @@ func (c *Client) Start() error {
 				newMsg := Message{Type: "list", TargetUUID: c.clientUUID, DateTime: GetTimestamp()}
 				c.writeToConnection(conn, newMsg)
 
+			// request unread mentions
+			case "mentions":
+				newMsg := Message{Type: "mentions", TargetUUID: c.clientUUID, DateTime: GetTimestamp()}
+				c.writeToConnection(conn, newMsg)
+
+			// mark all mentions as read
+			case "clear_mentions":
+				newMsg := Message{Type: "clear_mentions", TargetUUID: c.clientUUID, DateTime: GetTimestamp()}
+				c.writeToConnection(conn, newMsg)
+
 			// exit client
 			case "exit":
 				c.exit <- struct{}{}
@@ -93,21 +118,198 @@ func (c *Client) Start() error {
 				case "create":
 					newMsg = Message{Type: "create", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
 
+				// create private chat room
+				case "create_private":
+					newMsg = Message{Type: "create", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Private: true}
+
+				// invite user to chat room
+				case "invite":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: "invite", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Target: inputComponents[2]}
+
+				// grant a room role to a member
+				case "grant":
+					if len(inputComponents) < 4 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: "grant_role", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Target: inputComponents[2], Role: inputComponents[3]}
+
+				// revoke a member's room role
+				case "revoke":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: "revoke_role", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Target: inputComponents[2]}
+
+				// remove a member from a chat room, ban a user from it or mute a member,
+				// optionally for a duration and with a reason
+				case "kick", "ban", "mute":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: inputComponents[0], TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Target: inputComponents[2]}
+					if inputComponents[0] == "kick" {
+						newMsg.Text = strings.Join(inputComponents[3:], " ")
+					} else {
+						newMsg.Duration, newMsg.Text = parseSanction(inputComponents[3:])
+					}
+
+				// lift a user's ban from or mute in a chat room
+				case "unban", "unmute":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: inputComponents[0], TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Target: inputComponents[2]}
+
+				// set or clear a chat room's topic
+				case "topic":
+					newMsg = Message{Type: "set_topic", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Text: strings.Join(inputComponents[2:], " ")}
+
+				// request a chat room's information & settings
+				case "info":
+					newMsg = Message{Type: "room_info", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+
+				// change a chat room's maximum member count, retention & description
+				case "settings":
+					if len(inputComponents) < 4 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					maxMembers, err := strconv.Atoi(inputComponents[2])
+					if err != nil {
+						stdout <- "Unsupported command: maximum member count must be a number.\n"
+						continue
+					}
+					settings := &roomInfo{MaxMembers: maxMembers, Retention: inputComponents[3], Description: strings.Join(inputComponents[4:], " ")}
+					newMsg = Message{Type: "set_room_settings", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Info: settings}
+
+				// request chat rooms matching a filter and/or name prefix
+				case "list":
+					newMsg = Message{Type: "list", TargetUUID: c.clientUUID, DateTime: GetTimestamp()}
+					newMsg.Filter, newMsg.Text = parseListFilter(inputComponents[1:])
+
+				// request a chat room's moderation audit log
+				case "audit":
+					newMsg = Message{Type: "audit", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+
+				// accept invitation to chat room
+				case "accept":
+					newMsg = Message{Type: "accept_invite", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+
+				// decline invitation to chat room
+				case "decline":
+					newMsg = Message{Type: "decline_invite", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+
 				// destroy chat room
 				case "destroy":
 					newMsg = Message{Type: "destroy", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
 
-				// join chat room
+				// join chat room, optionally fetching a number of recent messages
 				case "join":
 					newMsg = Message{Type: "join", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+					if len(inputComponents) > 2 {
+						newMsg.Limit, _ = strconv.Atoi(inputComponents[2])
+					}
+
+				// request a page of chat room history, optionally before a message ID or timestamp
+				case "history":
+					newMsg = Message{Type: "history", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+					if len(inputComponents) > 2 {
+						newMsg.Limit, _ = strconv.Atoi(inputComponents[2])
+					}
+					if len(inputComponents) > 3 {
+						newMsg.Before = strings.Join(inputComponents[3:], " ")
+					}
+
+				// mark chat room messages as read, up to a message or the latest
+				case "read":
+					newMsg = Message{Type: "mark_read", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+					if len(inputComponents) > 2 {
+						newMsg.ID, newMsg.Seq = parseMessageRef(inputComponents[2])
+					}
+
+				// set presence status
+				case "status":
+					newMsg = Message{Type: "set_status", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Status: inputComponents[1]}
+
+				// request presence of chat room members
+				case "presence":
+					newMsg = Message{Type: "presence", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
 
 				// leave chat room
 				case "leave":
 					newMsg = Message{Type: "leave", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
 
+				// edit a chat room message, identified by sequence number or ID
+				case "edit":
+					if len(inputComponents) < 4 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					msgText := strings.Join(inputComponents[3:], " ")
+					newMsg = Message{Type: "edit_msg", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Text: msgText}
+					newMsg.ID, newMsg.Seq = parseMessageRef(inputComponents[2])
+
+				// reply to a chat room message, identified by sequence number or ID
+				case "reply":
+					if len(inputComponents) < 4 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					msgText := strings.Join(inputComponents[3:], " ")
+					newMsg = Message{Type: "new_msg", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Text: msgText}
+					newMsg.ParentID, newMsg.ParentSeq = parseMessageRef(inputComponents[2])
+
+				// request the thread of a chat room message
+				case "thread":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: "thread", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+					newMsg.ID, newMsg.Seq = parseMessageRef(inputComponents[2])
+
+				// add or remove a reaction to a chat room message
+				case "react", "unreact":
+					if len(inputComponents) < 4 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: inputComponents[0], TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1], Emoji: inputComponents[3]}
+					newMsg.ID, newMsg.Seq = parseMessageRef(inputComponents[2])
+
+				// delete a chat room message, identified by sequence number or ID
+				case "delete":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					newMsg = Message{Type: "delete_msg", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[1]}
+					newMsg.ID, newMsg.Seq = parseMessageRef(inputComponents[2])
+
+				// send direct message to user
+				case "dm":
+					if len(inputComponents) < 3 {
+						stdout <- "Unsupported command: too few parameters.\n"
+						continue
+					}
+					msgText := strings.Join(inputComponents[2:], " ")
+					newMsg = Message{Type: "dm", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Target: inputComponents[1], Text: msgText}
+
+				// request direct message history with user
+				case "dm_history":
+					newMsg = Message{Type: "dm_history", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Target: inputComponents[1]}
+
 				// send msg to chat room
 				default:
-					msgText := strings.Join(inputComponents[1:], ",")
+					msgText := strings.Join(inputComponents[1:], " ")
 					newMsg = Message{Type: "new_msg", TargetUUID: c.clientUUID, DateTime: GetTimestamp(), Room: inputComponents[0], Text: msgText}
 				}
 
@@ -128,19 +330,35 @@ func (c *Client) Start() error {
 	return nil
 }
 
+// Connect to the server, over TLS if enabled.
+func (c *Client) dial() (net.Conn, error) {
+	address := c.host + ":" + strconv.Itoa(c.port)
+	if *useTLS == false {
+		return net.Dial(c.protocol, address)
+	}
+
+	if c.protocol != "tcp" {
+		return nil, fmt.Errorf("TLS is only supported over tcp")
+	}
+	config, err := clientTLSConfig(c.host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", address, config)
+}
+
 // Read messages from connection.
 func (c *Client) readFromConnection(conn net.Conn) {
-	// continuously poll for messages
+	// continuously poll for messages, reusing the reader so buffered responses are not lost
+	reader := bufio.NewReader(conn)
 	for {
-		response, err := bufio.NewReader(conn).ReadString('\n')
+		response, err := reader.ReadString('\n')
 		if err != nil {
 			log.Fatalln("> Server closed connection.")
 		}
 
-		// pass new response to web UI feed
-		go func() {
-			c.httpServer.refreshFeed <- response
-		}()
+		// pass new response to web UI event streams
+		c.httpServer.events.publish(strings.TrimSpace(response))
 
 		// push request job into channel for processing
 		var msg Message
@@ -157,11 +375,23 @@ func (c *Client) processResponse(msg Message) {
 		return
 	}
 
+	// keep the identity & token issued on authentication
+	if msg.Token != "" {
+		c.authMu.Lock()
+		c.clientUUID = msg.TargetUUID
+		c.token = msg.Token
+		c.authMu.Unlock()
+	}
+
 	switch msg.Type {
 	// join server for the first time
 	case "set_name":
 		stdout <- msg.Text + "\n"
 
+	// log in as an existing user
+	case "login":
+		stdout <- msg.Text + "\n"
+
 	// create a chat room
 	case "create":
 		stdout <- msg.Text + "\n"
@@ -174,12 +404,81 @@ func (c *Client) processResponse(msg Message) {
 		}
 		stdout <- fmt.Sprintf("[%s]: This room has been destroyed by '%s'.\n", msg.Room, msg.Username)
 
+	// an invitation to join a chat room was sent to or by this user
+	case "invite":
+		if msg.Target == c.username {
+			stdout <- fmt.Sprintf("[%s]: '%s' invited you to join the room. Use \"accept %s\" or \"decline %s\" to respond.\n", msg.Room, msg.Username, msg.Room, msg.Room)
+			return
+		}
+		stdout <- fmt.Sprintf("[%s]: You invited '%s' to join the room.\n", msg.Room, msg.Target)
+
+	// an invitation to join a chat room was declined
+	case "decline_invite":
+		if msg.Username == c.username {
+			stdout <- fmt.Sprintf("[%s]: You declined the invitation.\n", msg.Room)
+			return
+		}
+		stdout <- fmt.Sprintf("[%s]: '%s' declined your invitation.\n", msg.Room, msg.Username)
+
+	// a room member's role changed
+	case "grant_role", "revoke_role":
+		if msg.Target == c.username {
+			stdout <- fmt.Sprintf("[%s]: '%s' gave you the %s role.\n", msg.Room, msg.Username, msg.Role)
+			return
+		}
+		stdout <- fmt.Sprintf("[%s]: '%s' gave '%s' the %s role.\n", msg.Room, msg.Username, msg.Target, msg.Role)
+
+	// a moderation action was taken in a chat room
+	case "kick", "ban", "unban", "mute", "unmute":
+		stdout <- fmt.Sprintf("[%s]: %s\n", msg.Room, msg.Text)
+
+	// a chat room's topic or settings changed
+	case "set_topic", "set_room_settings":
+		stdout <- fmt.Sprintf("[%s]: %s\n", msg.Room, msg.Text)
+
+	// information & settings of a chat room
+	case "room_info":
+		info := msg.Info
+		name := info.Name
+		if info.Private {
+			name += " (private)"
+		}
+		members := strconv.Itoa(info.Members)
+		if info.MaxMembers > 0 {
+			members += fmt.Sprintf(" of %d", info.MaxMembers)
+		}
+		retention := info.Retention
+		if retention == "" {
+			retention = "forever"
+		}
+		stdout <- fmt.Sprintf("[%s]: Topic: %s\n", name, info.Topic)
+		stdout <- fmt.Sprintf("[%s]: Description: %s\n", name, info.Description)
+		stdout <- fmt.Sprintf("[%s]: Created by '%s' at %s, %s members, messages kept for %s\n", name, info.Creator, info.Created, members, retention)
+
+	// moderation audit log of a chat room
+	case "audit":
+		if len(msg.Messages) == 0 {
+			stdout <- fmt.Sprintf("[%s]: No moderation actions recorded\n", msg.Room)
+			return
+		}
+		for _, entry := range msg.Messages {
+			stdout <- fmt.Sprintf("[%s audit %s]: %s\n", msg.Room, entry.DateTime, entry.Text)
+		}
+
 	// join server for the first time
 	case "list":
-		if len(msg.Text) == 0 {
+		if len(msg.Rooms) == 0 {
 			stdout <- "No rooms available\n"
+			return
+		}
+		stdout <- "Available chat rooms:\n"
+		for _, r := range msg.Rooms {
+			stdout <- formatRoomSummary(r) + "\n"
 		}
-		stdout <- "Available chat rooms: " + msg.Text + "\n"
+
+	// the user's room read marker moved
+	case "mark_read":
+		stdout <- fmt.Sprintf("[%s]: Read up to #%d, %d unread\n", msg.Room, msg.Seq, msg.Unread[msg.Room])
 
 	// join a chat room
 	case "join":
@@ -199,15 +498,119 @@ func (c *Client) processResponse(msg Message) {
 
 	// a standard message to a server room
 	case "new_msg":
-		stdout <- fmt.Sprintf("[%s] %s: %s\n", msg.Room, msg.Username, msg.Text)
+		if msg.ParentSeq != 0 {
+			stdout <- fmt.Sprintf("[%s #%d reply to #%d] %s: %s\n", msg.Room, msg.Seq, msg.ParentSeq, msg.Username, msg.Text)
+			return
+		}
+		stdout <- fmt.Sprintf("[%s #%d] %s: %s\n", msg.Room, msg.Seq, msg.Username, msg.Text)
+
+	// a chat room message was edited
+	case "edit_msg":
+		stdout <- fmt.Sprintf("[%s #%d] %s (edited): %s\n", msg.Room, msg.Seq, msg.Username, msg.Text)
+
+	// a chat room message was deleted
+	case "delete_msg":
+		stdout <- fmt.Sprintf("[%s #%d]: Message from '%s' deleted by '%s'.\n", msg.Room, msg.Seq, msg.Username, msg.Target)
+
+	// a direct message sent to or by this user
+	case "dm":
+		stdout <- fmt.Sprintf("[dm] %s -> %s: %s\n", msg.Username, msg.Target, msg.Text)
+
+	// direct message history with a user
+	case "dm_history":
+		if len(msg.Messages) == 0 {
+			stdout <- fmt.Sprintf("No direct messages with '%s'\n", msg.Target)
+			return
+		}
+		for _, dm := range msg.Messages {
+			stdout <- fmt.Sprintf("[dm %s] %s -> %s: %s\n", dm.DateTime, dm.Username, dm.Target, dm.Text)
+		}
+
+	// a reaction was added to a chat room message
+	case "react":
+		stdout <- fmt.Sprintf("[%s #%d] %s reacted %s to '%s'%s\n", msg.Room, msg.Seq, msg.Target, msg.Emoji, msg.Text, formatReactions(msg.Reactions))
+
+	// a reaction was removed from a chat room message
+	case "unreact":
+		stdout <- fmt.Sprintf("[%s #%d] %s removed their %s reaction to '%s'%s\n", msg.Room, msg.Seq, msg.Target, msg.Emoji, msg.Text, formatReactions(msg.Reactions))
+
+	// a user's presence status changed
+	case "status":
+		stdout <- fmt.Sprintf("%s is now %s\n", msg.Username, msg.Status)
+
+	// presence of chat room members
+	case "presence":
+		members := make([]string, len(msg.Members))
+		for i, member := range msg.Members {
+			members[i] = member.Username + " (" + member.Role + ", " + member.Status + ")"
+		}
+		stdout <- fmt.Sprintf("[%s] Members: %s\n", msg.Room, strings.Join(members, ", "))
+
+	// typing notifications are only shown in the web UI
+	case "typing":
+		return
+
+	// this user was mentioned in a chat room message
+	case "mention":
+		stdout <- fmt.Sprintf("[%s #%d] %s mentioned you: %s\n", msg.Room, msg.Seq, msg.Username, msg.Text)
+
+	// unread mentions of this user
+	case "mentions":
+		if len(msg.Messages) == 0 {
+			stdout <- "No unread mentions\n"
+			return
+		}
+		for _, mention := range msg.Messages {
+			stdout <- fmt.Sprintf("[%s #%d %s] %s mentioned you: %s\n", mention.Room, mention.Seq, mention.DateTime, mention.Username, mention.Text)
+		}
+
+	// mentions were marked as read
+	case "clear_mentions":
+		stdout <- "Mentions marked as read\n"
+
+	// a page of chat room history
+	case "history":
+		if len(msg.Messages) == 0 {
+			stdout <- fmt.Sprintf("[%s]: No earlier messages\n", msg.Room)
+			return
+		}
+		for _, roomMsg := range msg.Messages {
+			stdout <- formatStoredMessage(msg.Room, roomMsg)
+		}
+		stdout <- fmt.Sprintf("[%s]: Earlier messages are before ID %s\n", msg.Room, msg.Messages[0].ID)
+
+	// a page of a message thread
+	case "thread":
+		stdout <- fmt.Sprintf("[%s]: Thread of message #%d\n", msg.Room, msg.Seq)
+		for _, roomMsg := range msg.Messages {
+			stdout <- formatStoredMessage(msg.Room, roomMsg)
+		}
 
 	default:
 		stdout <- "> Request message type not recognised\n"
 	}
 }
 
+// Periodically send a heartbeat request to keep the session alive.
+func (c *Client) sendHeartbeats(conn net.Conn) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.writeToConnection(conn, Message{Type: "heartbeat", DateTime: GetTimestamp()})
+	}
+}
+
 // Write message to connection.
 func (c *Client) writeToConnection(conn net.Conn, msg Message) {
+	// make requests as the authenticated user; UDP requests are not tied to a
+	// connection so each also carries the session token
+	c.authMu.Lock()
+	msg.TargetUUID = c.clientUUID
+	if c.protocol == "udp" {
+		msg.Token = c.token
+	}
+	c.authMu.Unlock()
+
 	str, err := msg.marshalRequest()
 
 	if err != nil {
@@ -219,25 +622,111 @@ func (c *Client) writeToConnection(conn net.Conn, msg Message) {
 	}
 }
 
-// Read UUID from file or generate a new one if file does not exist.
+// Format a chat room message from a history or thread page for the console.
+func formatStoredMessage(roomName string, msg Message) string {
+	text := msg.Text
+	if msg.Deleted {
+		text = "(deleted)"
+	} else if len(msg.Revisions) > 0 {
+		text += " (edited)"
+	}
+	if msg.Replies > 0 {
+		text += fmt.Sprintf(" (%d replies)", msg.Replies)
+	}
+	return fmt.Sprintf("[%s #%d %s] %s: %s%s\n", roomName, msg.Seq, msg.DateTime, msg.Username, text, formatReactions(msg.Reactions))
+}
+
+// Format the reaction counts of a message for the console.
+func formatReactions(reactions []reaction) string {
+	if len(reactions) == 0 {
+		return ""
+	}
+	counts := make([]string, len(reactions))
+	for i, r := range reactions {
+		counts[i] = fmt.Sprintf("%s %d", r.Emoji, r.Count)
+	}
+	return " [" + strings.Join(counts, ", ") + "]"
+}
+
+// Parse a console reference to a message, which is either its room sequence
+// number or its ID.
+func parseMessageRef(ref string) (UUID, uint64) {
+	seq, err := strconv.ParseUint(ref, 10, 64)
+	if err != nil {
+		return UUID(ref), 0
+	}
+	return "", seq
+}
+
+// Split the parameters of a list command into an optional filter (all,
+// joined, public or private) and a room name prefix.
+func parseListFilter(params []string) (string, string) {
+	if len(params) > 0 && validListFilter(params[0]) {
+		return params[0], strings.Join(params[1:], " ")
+	}
+	return "", strings.Join(params, " ")
+}
+
+// Format a listed chat room for display, e.g. "room_1 (3 members, private, 2
+// unread) - topic".
+func formatRoomSummary(r roomSummary) string {
+	details := []string{fmt.Sprintf("%d members", r.Members)}
+	if r.Private {
+		details = append(details, "private")
+	}
+	if r.Joined {
+		details = append(details, "joined")
+		if r.Unread > 0 {
+			details = append(details, fmt.Sprintf("%d unread", r.Unread))
+		}
+	}
+	line := fmt.Sprintf("  %s (%s)", r.Name, strings.Join(details, ", "))
+	if r.Topic != "" {
+		line += " - " + r.Topic
+	}
+	return line
+}
+
+// Split the optional parameters of a ban or mute command into a duration
+// (e.g. 30m or 24h) and a reason.
+func parseSanction(params []string) (string, string) {
+	if len(params) > 0 {
+		if _, err := time.ParseDuration(params[0]); err == nil {
+			return params[0], strings.Join(params[1:], " ")
+		}
+	}
+	return "", strings.Join(params, " ")
+}
+
+// Read UUID from file or generate a new one if file does not exist, then
+// log in or register the user name with a password.
 func (c *Client) initUUID(conn net.Conn) UUID {
 	// UUID file path
 	workingDir, err := os.Getwd()
 	name := getConsoleInput("Enter new or previously used user name")
+	password := getConsoleInput("Enter password")
 	uuidFilePath = workingDir + "/data/" + name + ".dat"
 
 	// attempt to read UUID from file
 	uuid, err := c.readUUIDFromFile(uuidFilePath)
-	if err != nil {
+	newUser := err != nil
+	if newUser {
 		// file did not exist, generate new UUID and save to new file
 		uuid, err = c.generateUUIDFile(workingDir + "/data/" + name + ".dat")
 		if err != nil {
 			log.Fatal("Could not locate existing or generate new client ID.")
 		}
+	}
+	c.clientUUID = UUID(uuid)
 
+	if newUser {
 		// set new user name on server
-		nameMsg := Message{Type: "set_name", TargetUUID: UUID(uuid), DateTime: GetTimestamp(), Text: name}
+		nameMsg := Message{Type: "set_name", TargetUUID: UUID(uuid), DateTime: GetTimestamp(), Text: name, Secret: password}
 		c.writeToConnection(conn, nameMsg)
+	} else {
+		// log in as existing user
+		loginMsg := Message{Type: "login", TargetUUID: UUID(uuid), DateTime: GetTimestamp(), Username: name, Secret: password}
+		c.writeToConnection(conn, loginMsg)
 	}
 
 	c.username = name
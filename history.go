@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Number of messages returned by a history request which does not specify a
+// limit, and the most returned by any single request.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// Select a page of at most limit messages from a room's message log. Only
+// messages before and after the optional cursors are considered; a cursor is
+// a message ID, sequence number or timestamp. The most recent messages are
+// returned unless only an after cursor is given, in which case the page
+// starts directly after it so clients can page forwards.
+func historyPage(msgs []Message, before string, after string, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	// narrow the log down to the messages between the cursors
+	start, end := 0, len(msgs)
+	if after != "" {
+		i, err := historyCursor(msgs, after, false)
+		if err != nil {
+			return nil, err
+		}
+		start = i
+	}
+	if before != "" {
+		i, err := historyCursor(msgs, before, true)
+		if err != nil {
+			return nil, err
+		}
+		end = i
+	}
+	if start >= end {
+		return []Message{}, nil
+	}
+
+	if after != "" && before == "" {
+		if end-start > limit {
+			end = start + limit
+		}
+	} else if end-start > limit {
+		start = end - limit
+	}
+
+	page := make([]Message, end-start)
+	copy(page, msgs[start:end])
+	return page, nil
+}
+
+// Get the top level messages of a room's message log, leaving out thread
+// replies. Each message is given the number of replies in its thread.
+func topLevelMessages(msgs []Message) []Message {
+	replies := make(map[UUID]int)
+	for _, msg := range msgs {
+		if msg.ParentID != "" {
+			replies[msg.ParentID]++
+		}
+	}
+
+	top := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.ParentID == "" {
+			msg.Replies = replies[msg.ID]
+			top = append(top, msg)
+		}
+	}
+	return top
+}
+
+// Get the messages of a thread from a room's message log: the parent message
+// followed by its replies. Replies are always stored after their parent.
+func threadMessages(msgs []Message, parentID UUID) []Message {
+	var thread []Message
+	for _, msg := range msgs {
+		if msg.ID == parentID || msg.ParentID == parentID {
+			thread = append(thread, msg)
+		}
+	}
+	if len(thread) > 0 {
+		thread[0].Replies = len(thread) - 1
+	}
+	return thread
+}
+
+// Get the index in a message log which a history cursor refers to. A before
+// cursor is exclusive, so the index of the first message at or after it is
+// returned. For an after cursor, the index of the first message following it
+// is returned.
+func historyCursor(msgs []Message, cursor string, before bool) (int, error) {
+	// look for a message with a matching ID
+	for i := range msgs {
+		if string(msgs[i].ID) == cursor {
+			if before {
+				return i, nil
+			}
+			return i + 1, nil
+		}
+	}
+
+	// messages are stored in sequence order
+	if seq, err := strconv.ParseUint(cursor, 10, 64); err == nil {
+		return sort.Search(len(msgs), func(i int) bool {
+			if before {
+				return msgs[i].Seq >= seq
+			}
+			return msgs[i].Seq > seq
+		}), nil
+	}
+
+	// otherwise treat the cursor as a timestamp
+	t, err := parseTimestamp(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("history cursor '%s' is not a known message ID, sequence number or timestamp", cursor)
+	}
+	return sort.Search(len(msgs), func(i int) bool {
+		msgTime, err := messageTime(msgs[i])
+		if err != nil {
+			return false
+		}
+		if before {
+			return msgTime.Equal(t) || msgTime.After(t)
+		}
+		return msgTime.After(t)
+	}), nil
+}
+
+// Get the time a message was sent at, falling back to the minute resolution
+// DateTime for messages stored without a timestamp.
+func messageTime(msg Message) (time.Time, error) {
+	if msg.Timestamp != "" {
+		return time.Parse(time.RFC3339Nano, msg.Timestamp)
+	}
+	return parseTimestamp(msg.DateTime)
+}
+
+// Parse a timestamp in either the message DateTime format or RFC 3339.
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := time.ParseInLocation(timestampFormat, value, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
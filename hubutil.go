@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"strings"
 	"time"
@@ -21,6 +22,97 @@ type Message struct {
 	TargetUUID UUID
 	Error      string
 	Username   string
+	Secret     string
+	Token      string
+	Target     string
+	Messages   []Message
+	ID         UUID
+	Limit      int
+	Before     string
+	After      string
+	Seq        uint64
+	Timestamp  string
+	Deleted    bool
+	Revisions  []revision
+	ParentID   UUID
+	ParentSeq  uint64
+	Replies    int
+	Emoji      string
+	Reactions  []reaction
+	Status     string
+	Members    []presence
+	Unread     map[string]int
+	Private    bool
+	Role       string
+	Duration   string
+	Expires    string
+	Info       *roomInfo
+	Rooms      []roomSummary
+	Filter     string
+}
+
+// Longest emoji or short code accepted as a reaction, in characters.
+const maxEmojiLength = 32
+
+// The users who reacted to a message with an emoji.
+type reaction struct {
+	Emoji string
+	Count int
+	Users []string
+}
+
+// Add a user's reaction to a message. False is returned if the user had
+// already reacted with the emoji.
+func (m *Message) AddReaction(emoji string, userName string) bool {
+	// copy reactions rather than modifying those shared with the stored message
+	m.Reactions = append([]reaction(nil), m.Reactions...)
+	for i := range m.Reactions {
+		if m.Reactions[i].Emoji != emoji {
+			continue
+		}
+		for _, name := range m.Reactions[i].Users {
+			if name == userName {
+				return false
+			}
+		}
+		m.Reactions[i].Users = append(m.Reactions[i].Users, userName)
+		m.Reactions[i].Count = len(m.Reactions[i].Users)
+		return true
+	}
+	m.Reactions = append(m.Reactions, reaction{Emoji: emoji, Count: 1, Users: []string{userName}})
+	return true
+}
+
+// Remove a user's reaction from a message, dropping the emoji once nobody is
+// left reacting with it. False is returned if the user had not reacted with
+// the emoji.
+func (m *Message) RemoveReaction(emoji string, userName string) bool {
+	m.Reactions = append([]reaction(nil), m.Reactions...)
+	for i := range m.Reactions {
+		if m.Reactions[i].Emoji != emoji {
+			continue
+		}
+		for j, name := range m.Reactions[i].Users {
+			if name != userName {
+				continue
+			}
+			users := append([]string(nil), m.Reactions[i].Users[:j]...)
+			m.Reactions[i].Users = append(users, m.Reactions[i].Users[j+1:]...)
+			m.Reactions[i].Count = len(m.Reactions[i].Users)
+			if m.Reactions[i].Count == 0 {
+				m.Reactions = append(m.Reactions[:i], m.Reactions[i+1:]...)
+			}
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// A previous version of an edited message.
+type revision struct {
+	Text      string
+	Timestamp string
 }
 
 // Marshal message into string.
@@ -34,6 +126,11 @@ func (m *Message) marshalRequest() (string, error) {
 
 // Marshall message into string and pipe to output channel.
 func (m *Message) marshalRequestToChan(out chan string) {
+	// users restored from file have no connection to write to
+	if out == nil {
+		return
+	}
+
 	str, err := json.Marshal(m)
 	if err != nil {
 		out <- err.Error()
@@ -47,98 +144,203 @@ func (m *Message) unmarshalRequest(request string) {
 	json.Unmarshal([]byte(request), m)
 }
 
-var (
-	// all chat rooms (key is room name, value is user object)
-	rooms = make(map[string]*room)
-	// all connected clients (key is UUID, value is user object)
-	users = make(map[UUID]*user)
-)
+// Server data store holding rooms, memberships, users and messages.
+var store Store = newMemoryStore()
 
-// A chat room containing users and all room messages.
+// A chat room. Room members and messages are held by the store. Private rooms
+// are only visible to their creator, members & invited users.
 type room struct {
-	userIDs  map[UUID]bool
-	messages []Message
-	creator  UUID
+	Name    string
+	Creator UUID
+	Private bool
+	Invited map[UUID]bool
+	Roles   map[UUID]string
+
+	// information & settings
+	Topic       string
+	Description string
+	Created     string
+	MaxMembers  int
+	Retention   string
+
+	// moderation (key is user ID, value is the expiry or empty if indefinite)
+	Banned   map[UUID]string
+	Muted    map[UUID]string
+	AuditLog []Message
 }
 
 // Create & initialise room.
-func NewRoom(name string, creator UUID) (*room, error) {
+func NewRoom(name string, creator UUID, private bool) (*room, error) {
 	// check if room name is already taken
-	if _, ok := rooms[name]; ok {
+	if RoomExists(name) {
 		return nil, fmt.Errorf("a room by that name already exists")
 	}
 
-	// add new room to rooms map
-	r := &room{creator: creator, userIDs: make(map[UUID]bool)}
-	rooms[name] = r
+	// add new room to the store
+	r := &room{Name: name, Creator: creator, Private: private, Created: time.Now().Format(time.RFC3339Nano)}
+	err := store.SaveRoom(r)
+	if err != nil {
+		return nil, err
+	}
 
 	return r, nil
 }
 
-// Remove user from chat room.
+// Remove chat room along with its members and messages.
 func RemoveRoom(roomName string) {
-	delete(rooms, roomName)
+	logStoreError(store.DeleteRoom(roomName))
 }
 
 // Check if a room exists.
 func RoomExists(name string) bool {
-	_, ok := rooms[name]
+	_, ok := store.Room(name)
 	return ok
 }
 
 // Add user to chat room.
 func (r *room) AddUser(userID UUID) {
-	r.userIDs[userID] = true
+	logStoreError(store.AddMember(r.Name, userID))
 }
 
 // Remove user from chat room.
 func (r *room) RemoveUser(userID UUID) {
-	delete(r.userIDs, userID)
+	logStoreError(store.RemoveMember(r.Name, userID))
 }
 
 // Check if user is subscribed to a room.
 func (r *room) IsUserSubscribed(userID UUID) bool {
-	_, ok := r.userIDs[userID]
-	return ok
+	return store.IsMember(r.Name, userID)
+}
+
+// Check if a user can see a room.
+func (r *room) VisibleTo(userID UUID) bool {
+	return r.Private == false || r.Creator == userID || r.IsInvited(userID) || r.IsUserSubscribed(userID)
+}
+
+// Check if a user can read a room's messages & members. Private rooms are only
+// readable by their members, not by users who have just been invited.
+func (r *room) ReadableBy(userID UUID) bool {
+	return r.Private == false || r.Creator == userID || r.IsUserSubscribed(userID)
 }
 
-// Add a message to a chat room.
-func (r *room) AddMessage(userID UUID, text string, msgType string) {
-	// construct message and store
-	msg := Message{Text: text, Type: msgType, DateTime: GetTimestamp(), TargetUUID: userID}
-	r.messages = append(r.messages, msg)
+// Check if a user has an outstanding invitation to join a room.
+func (r *room) IsInvited(userID UUID) bool {
+	return r.Invited[userID]
 }
 
-// Send message to all clients in room.
-func (r *room) Broadcast(msg Message) {
-	for id := range r.userIDs {
-		msg.marshalRequestToChan(users[UUID(id)].Out)
+// Invite a user to join a room.
+func (r *room) Invite(userID UUID) {
+	if r.Invited == nil {
+		r.Invited = make(map[UUID]bool)
 	}
+	r.Invited[userID] = true
+	logStoreError(store.SaveRoom(r))
 }
 
+// Remove a user's invitation to a room once it is accepted or declined.
+func (r *room) RemoveInvite(userID UUID) {
+	delete(r.Invited, userID)
+	logStoreError(store.SaveRoom(r))
+}
+
+// Get the names of all rooms visible to a user.
+func VisibleRoomNames(userID UUID) []string {
+	var names []string
+	for _, name := range store.RoomNames() {
+		if r, ok := store.Room(name); ok && r.VisibleTo(userID) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Add a message to a chat room, numbering it with the room's next sequence
+// number.
+func (r *room) AddMessage(msg *Message) {
+	logStoreError(store.AppendMessage(r.Name, msg))
+}
+
+// Find a message in a chat room by its ID, or by its sequence number if no ID
+// is given.
+func (r *room) FindMessage(id UUID, seq uint64) (Message, bool) {
+	for _, msg := range store.Messages(r.Name) {
+		if (id != "" && msg.ID == id) || (id == "" && msg.Seq == seq) {
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// Find the message at the root of the thread containing a chat room message.
+// Threads are a single level deep, so replying to a reply adds to the thread
+// of the message it replied to.
+func (r *room) FindThreadParent(id UUID, seq uint64) (Message, error) {
+	msg, found := r.FindMessage(id, seq)
+	if found == false || msg.Type != "new_msg" {
+		return Message{}, fmt.Errorf("specified message does not exist")
+	}
+	if msg.ParentID != "" {
+		msg, found = r.FindMessage(msg.ParentID, 0)
+		if found == false {
+			return Message{}, fmt.Errorf("specified message does not exist")
+		}
+	}
+	return msg, nil
+}
+
+// Replace a stored chat room message with a modified version.
+func (r *room) UpdateMessage(msg Message) {
+	logStoreError(store.UpdateMessage(r.Name, msg))
+}
+
+// Layout of message date & time stamps.
+const timestampFormat = "_2/01/06 15:04"
+
 // Get a formatted date & time stamp.
 func GetTimestamp() string {
-	return time.Now().Format("_2/01/06 15:04")
+	return time.Now().Format(timestampFormat)
 }
 
 // Represents a single user.
 type user struct {
-	Name   string
-	Online bool
-	Out    chan string
+	Name         string
+	Online       bool
+	PasswordHash []byte
+	Pending      []Message
+	Mentions     []Message
+	Status       string
+	LastRead     map[string]uint64
 }
 
 // Add a new user.
-func NewUser(uuid UUID, name string, out chan string) {
-	users[uuid] = &user{Name: name, Out: out}
+func NewUser(uuid UUID, name string, passwordHash []byte) {
+	logStoreError(store.SaveUser(uuid, &user{Name: name, PasswordHash: passwordHash}))
 }
 
 // Check if user exists.
 func UserExists(name UUID) bool {
-	_, ok := users[name]
+	_, ok := store.User(name)
 	return ok
 }
 
+// Find a user by their user name.
+func FindUserByName(name string) (UUID, *user, bool) {
+	for _, id := range store.UserIDs() {
+		u, ok := store.User(id)
+		if ok && u.Name == name {
+			return id, u, true
+		}
+	}
+	return "", nil, false
+}
+
+// Log a failed store write.
+func logStoreError(err error) {
+	if err != nil {
+		log.Println("store error: " + err.Error())
+	}
+}
+
 // Channel for all std print output.
 var stdout = make(chan string)
 
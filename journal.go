@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported journal fsync policies.
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
+)
+
+// Journal tuning.
+const (
+	journalSegmentMaxSize  = 4 << 20
+	journalEntryMaxSize    = 1 << 20
+	journalCompactEntries  = 1000
+	journalCompactInterval = 5 * time.Minute
+	journalSyncInterval    = time.Second
+)
+
+// The journal of the running server, nil if journaling is disabled.
+var activeJournal *journal
+
+// An append-only log of accepted requests split into numbered segment files.
+type journal struct {
+	mu       sync.Mutex
+	dir      string
+	policy   string
+	file     *os.File
+	segment  int
+	size     int64
+	entries  int
+	unsynced bool
+}
+
+// Open the journal in the specified directory. All requests recorded in
+// segments at or after the checkpoint segment are returned for replay and a
+// fresh segment is started for new requests.
+func openJournal(dir string, policy string, checkpoint int) (*journal, []Message, error) {
+	if policy != SyncAlways && policy != SyncInterval && policy != SyncNever {
+		return nil, nil, fmt.Errorf("unsupported fsync policy '%s'", policy)
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// collect requests to replay & remove segments already covered by the snapshot
+	var pending []Message
+	next := checkpoint
+	for _, segment := range segments {
+		if segment < checkpoint {
+			os.Remove(segmentPath(dir, segment))
+			continue
+		}
+		entries, err := readSegment(segmentPath(dir, segment))
+		if err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, entries...)
+		next = segment + 1
+	}
+
+	j := &journal{dir: dir, policy: policy, entries: len(pending)}
+	err = j.openSegment(next)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return j, pending, nil
+}
+
+// Append a request to the journal.
+func (j *journal) Append(msg Message) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return fmt.Errorf("journal is closed")
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(line) > journalEntryMaxSize {
+		return fmt.Errorf("journal entry of %d bytes exceeds the %d byte limit", len(line), journalEntryMaxSize)
+	}
+	n, err := j.file.Write(append(line, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	j.entries++
+	j.unsynced = true
+
+	if j.policy == SyncAlways {
+		err = j.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// start a new segment once the current one is full
+	if j.size >= journalSegmentMaxSize {
+		return j.rotate()
+	}
+	return nil
+}
+
+// Flush any unsynced journal writes to disk.
+func (j *journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sync()
+}
+
+// Check if enough requests have been journaled since the last compaction to
+// warrant a new snapshot.
+func (j *journal) NeedsCompaction() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.entries >= journalCompactEntries
+}
+
+// Compact the journal into a snapshot. A new segment is started and the
+// snapshot function is passed its number as the checkpoint to replay from;
+// once the snapshot is stored all older segments are removed.
+func (j *journal) Compact(snapshot func(checkpoint int) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return fmt.Errorf("journal is closed")
+	}
+	if j.entries == 0 {
+		return nil
+	}
+
+	err := j.rotate()
+	if err != nil {
+		return err
+	}
+	err = snapshot(j.segment)
+	if err != nil {
+		return err
+	}
+
+	// remove segments now covered by the snapshot
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment < j.segment {
+			os.Remove(segmentPath(j.dir, segment))
+		}
+	}
+	j.entries = 0
+
+	return nil
+}
+
+// Sync and close the journal.
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.sync()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
+
+// Flush the current segment to disk if required.
+func (j *journal) sync() error {
+	if !j.unsynced || j.policy == SyncNever {
+		return nil
+	}
+	err := j.file.Sync()
+	if err == nil {
+		j.unsynced = false
+	}
+	return err
+}
+
+// Close the current segment and start the next one.
+func (j *journal) rotate() error {
+	if j.unsynced && j.policy != SyncNever {
+		err := j.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err := j.file.Close()
+	if err != nil {
+		return err
+	}
+	return j.openSegment(j.segment + 1)
+}
+
+// Open a segment file for appending.
+func (j *journal) openSegment(segment int) error {
+	file, err := os.OpenFile(segmentPath(j.dir, segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	j.file = file
+	j.segment = segment
+	j.size = info.Size()
+	j.unsynced = false
+	return nil
+}
+
+// Get the file path of a segment.
+func segmentPath(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.log", segment))
+}
+
+// List the numbers of all segments in a journal directory in ascending order.
+func listSegments(dir string) ([]int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimSuffix(name, ".log"))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// Read all requests from a segment file. A torn entry left by a crash
+// mid-write, or an entry over the size limit, is skipped.
+func readSegment(filePath string) ([]Message, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Message
+	reader := bufio.NewReader(file)
+	for {
+		line, err := readJournalLine(reader)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			log.Printf("skipping journal entry over %d bytes in %s", journalEntryMaxSize, filePath)
+			continue
+		}
+
+		var msg Message
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			log.Printf("skipping corrupt journal entry in %s: %s", filePath, err.Error())
+			continue
+		}
+		entries = append(entries, msg)
+	}
+}
+
+// Read the next line of a segment. Lines over the entry size limit are
+// discarded without being held in memory and returned as nil. io.EOF is
+// returned once no lines remain.
+func readJournalLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if tooLong == false {
+			line = append(line, chunk...)
+			if len(line) > journalEntryMaxSize+1 {
+				line, tooLong = nil, true
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && (len(line) > 0 || tooLong) {
+			// final line without a newline
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			return nil, nil
+		}
+		return line, nil
+	}
+}
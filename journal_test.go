@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Open a journal in a temporary directory, failing the test on error.
+func openTestJournal(t *testing.T, dir string, checkpoint int) (*journal, []Message) {
+	t.Helper()
+	j, pending, err := openJournal(dir, SyncAlways, checkpoint)
+	if err != nil {
+		t.Fatalf("opening journal: %s", err)
+	}
+	return j, pending
+}
+
+func TestJournalReplaysAppendedEntries(t *testing.T) {
+	dir := t.TempDir()
+	j, pending := openTestJournal(t, dir, 0)
+	if len(pending) != 0 {
+		t.Fatalf("expected an empty journal, got %d entries", len(pending))
+	}
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := j.Append(Message{Type: "new_msg", Text: text}); err != nil {
+			t.Fatalf("appending entry: %s", err)
+		}
+	}
+	j.Close()
+
+	j, pending = openTestJournal(t, dir, 0)
+	defer j.Close()
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 entries to replay, got %d", len(pending))
+	}
+	for i, text := range []string{"one", "two", "three"} {
+		if pending[i].Text != text {
+			t.Errorf("entry %d: expected text '%s', got '%s'", i, text, pending[i].Text)
+		}
+	}
+}
+
+func TestJournalRejectsUnsupportedPolicy(t *testing.T) {
+	_, _, err := openJournal(t.TempDir(), "sometimes", 0)
+	if err == nil {
+		t.Fatal("expected an error for an unsupported fsync policy")
+	}
+}
+
+func TestJournalRejectsOversizedEntries(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir, 0)
+
+	err := j.Append(Message{Type: "new_msg", Text: strings.Repeat("x", journalEntryMaxSize)})
+	if err == nil {
+		t.Fatal("expected an error appending an oversized entry")
+	}
+	if err := j.Append(Message{Type: "new_msg", Text: "after"}); err != nil {
+		t.Fatalf("appending entry: %s", err)
+	}
+	j.Close()
+
+	j, pending := openTestJournal(t, dir, 0)
+	defer j.Close()
+	if len(pending) != 1 || pending[0].Text != "after" {
+		t.Fatalf("expected only the entry after the oversized one, got %v", pending)
+	}
+}
+
+func TestJournalSkipsUnreadableEntries(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir, 0)
+	j.Append(Message{Type: "new_msg", Text: "before"})
+	segment := j.segment
+	j.Close()
+
+	// write an over-long line, a torn entry and a valid entry after them
+	file, err := os.OpenFile(segmentPath(dir, segment), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Text":"` + strings.Repeat("x", journalEntryMaxSize+10) + "\"}\n")
+	file.WriteString(`{"Type":"new_msg","Te` + "\n")
+	file.WriteString(`{"Type":"new_msg","Text":"after"}` + "\n")
+	file.Close()
+
+	j, pending := openTestJournal(t, dir, 0)
+	defer j.Close()
+	if len(pending) != 2 || pending[0].Text != "before" || pending[1].Text != "after" {
+		t.Fatalf("expected the entries either side of the unreadable ones, got %d entries", len(pending))
+	}
+}
+
+func TestJournalCompactDiscardsCoveredSegments(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := openTestJournal(t, dir, 0)
+	j.Append(Message{Type: "new_msg", Text: "snapshotted"})
+
+	var checkpoint int
+	err := j.Compact(func(c int) error {
+		checkpoint = c
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("compacting journal: %s", err)
+	}
+	if j.NeedsCompaction() {
+		t.Error("expected no entries to remain after compaction")
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0] != checkpoint {
+		t.Fatalf("expected only checkpoint segment %d to remain, got %v", checkpoint, segments)
+	}
+
+	j.Append(Message{Type: "new_msg", Text: "journaled"})
+	j.Close()
+
+	// only requests made since the snapshot are replayed
+	j, pending := openTestJournal(t, dir, checkpoint)
+	defer j.Close()
+	if len(pending) != 1 || pending[0].Text != "journaled" {
+		t.Fatalf("expected only the entry after the snapshot, got %v", pending)
+	}
+}
+
+func TestJournalCompactSkipsEmptyJournal(t *testing.T) {
+	j, _ := openTestJournal(t, t.TempDir(), 0)
+	defer j.Close()
+
+	called := false
+	err := j.Compact(func(int) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("compacting journal: %s", err)
+	}
+	if called {
+		t.Error("expected no snapshot of an empty journal")
+	}
+}
@@ -1,11 +1,37 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 )
 
+// Command line configuration.
+var (
+	fsyncPolicy  = flag.String("fsync", SyncInterval, "server journal fsync policy: always, interval or never")
+	storeBackend = flag.String("store", MemoryStore, "server store backend: memory or bolt")
+	wsPort       = flag.Int("wsport", 9001, "server WebSocket port")
+	useTLS       = flag.Bool("tls", false, "use TLS for TCP connections")
+	tlsCertFile  = flag.String("tlscert", "data/cert.pem", "TLS certificate file (server certificate or optional client certificate)")
+	tlsKeyFile   = flag.String("tlskey", "data/key.pem", "TLS private key file")
+	tlsCAFile    = flag.String("tlsca", "", "TLS CA file used by clients to verify the server and by the server to require client certificates")
+	genCert      = flag.Bool("gencert", false, "generate a self-signed TLS certificate & key for local development and exit")
+)
+
 // Program entry point.
 func main() {
+	flag.Parse()
+
+	// generate development TLS certificate
+	if *genCert {
+		err := generateSelfSignedCert(*tlsCertFile, *tlsKeyFile, []string{"localhost", "127.0.0.1", "::1"})
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Printf("Self-signed certificate written to %s and key to %s.\n", *tlsCertFile, *tlsKeyFile)
+		return
+	}
+
 	// continuously write to console output
 	go writeToStdout()
 
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Maximum number of unread mentions kept for a user.
+const maxUnreadMentions = 200
+
+// Matches @name mentions in message text.
+var mentionPattern = regexp.MustCompile(`@(\S+)`)
+
+// Find the users mentioned in message text, in order of first mention. Any
+// punctuation directly following a name is ignored.
+func parseMentions(text string) []UUID {
+	var ids []UUID
+	found := make(map[UUID]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		id, _, ok := FindUserByName(match[1])
+		if !ok {
+			id, _, ok = FindUserByName(strings.TrimRight(match[1], ".,:;!?)'\""))
+		}
+		if ok && !found[id] {
+			found[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Notify each user mentioned in a room message, whether or not they are
+// subscribed to the room, and add it to their unread mentions. Only members of
+// a private room are notified of mentions in it.
+func notifyMentions(r *room, msg Message, authorID UUID) {
+	for _, id := range parseMentions(msg.Text) {
+		if id == authorID || (r.Private && r.IsUserSubscribed(id) == false) {
+			continue
+		}
+		u, ok := store.User(id)
+		if !ok {
+			continue
+		}
+
+		mention := msg
+		mention.Type = "mention"
+		mention.Target = u.Name
+		u.Mentions = append(u.Mentions, mention)
+		if len(u.Mentions) > maxUnreadMentions {
+			u.Mentions = u.Mentions[len(u.Mentions)-maxUnreadMentions:]
+		}
+		logStoreError(store.SaveUser(id, u))
+
+		// users who do not want to be disturbed still see the unread mention later
+		if u.Status != StatusDND {
+			sendToUser(id, mention)
+		}
+	}
+}
+
+// Mark one of a user's mentions as read, or all of them if no message ID is
+// given. False is returned if the mention is not unread.
+func clearMentions(userID UUID, id UUID) bool {
+	u, ok := store.User(userID)
+	if !ok {
+		return false
+	}
+
+	if id == "" {
+		u.Mentions = nil
+		logStoreError(store.SaveUser(userID, u))
+		return true
+	}
+	for i, mention := range u.Mentions {
+		if mention.ID == id {
+			u.Mentions = append(u.Mentions[:i:i], u.Mentions[i+1:]...)
+			logStoreError(store.SaveUser(userID, u))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Maximum number of moderation actions kept in a room's audit log.
+const maxAuditEntries = 500
+
+// Get the expiry of a ban or mute lasting a duration (e.g. "30m" or "24h")
+// from a time, or an empty string if no duration is given as it never expires.
+func sanctionExpiry(from time.Time, duration string) (string, error) {
+	if duration == "" {
+		return "", nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("invalid duration - use a positive duration such as 30m or 24h")
+	}
+	return from.Add(d).Format(time.RFC3339Nano), nil
+}
+
+// Check if a ban or mute with an expiry is still in force at a time.
+func sanctionActive(expiry string, at time.Time) bool {
+	if expiry == "" {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, expiry)
+	return err != nil || at.Before(t)
+}
+
+// Check if a user is banned from a room at a time.
+func (r *room) IsBanned(userID UUID, at time.Time) bool {
+	expiry, ok := r.Banned[userID]
+	return ok && sanctionActive(expiry, at)
+}
+
+// Check if a user is muted in a room at a time.
+func (r *room) IsMuted(userID UUID, at time.Time) bool {
+	expiry, ok := r.Muted[userID]
+	return ok && sanctionActive(expiry, at)
+}
+
+// Ban a user from joining a room until an expiry, or indefinitely if empty.
+func (r *room) Ban(userID UUID, expiry string) {
+	if r.Banned == nil {
+		r.Banned = make(map[UUID]string)
+	}
+	r.Banned[userID] = expiry
+	delete(r.Invited, userID)
+	logStoreError(store.SaveRoom(r))
+}
+
+// Lift a user's ban from a room.
+func (r *room) Unban(userID UUID) {
+	delete(r.Banned, userID)
+	logStoreError(store.SaveRoom(r))
+}
+
+// Stop a user from posting in a room until an expiry, or indefinitely if
+// empty.
+func (r *room) Mute(userID UUID, expiry string) {
+	if r.Muted == nil {
+		r.Muted = make(map[UUID]string)
+	}
+	r.Muted[userID] = expiry
+	logStoreError(store.SaveRoom(r))
+}
+
+// Lift a user's mute in a room.
+func (r *room) Unmute(userID UUID) {
+	delete(r.Muted, userID)
+	logStoreError(store.SaveRoom(r))
+}
+
+// Record a moderation action in the room's audit log, discarding the oldest
+// entries once the limit is reached.
+func (r *room) Audit(entry Message) {
+	r.AuditLog = append(r.AuditLog, entry)
+	if len(r.AuditLog) > maxAuditEntries {
+		r.AuditLog = r.AuditLog[len(r.AuditLog)-maxAuditEntries:]
+	}
+	logStoreError(store.SaveRoom(r))
+}
+
+// Describe a moderation action for display to the room.
+func describeSanction(action string, moderator string, target string, roomName string, expiry string, reason string) string {
+	var text string
+	switch action {
+	case "kick":
+		text = fmt.Sprintf("user '%s' was kicked from the '%s' room by '%s'", target, roomName, moderator)
+	case "ban":
+		text = fmt.Sprintf("user '%s' was banned from the '%s' room by '%s'", target, roomName, moderator)
+	case "unban":
+		text = fmt.Sprintf("user '%s' was unbanned from the '%s' room by '%s'", target, roomName, moderator)
+	case "mute":
+		text = fmt.Sprintf("user '%s' was muted in the '%s' room by '%s'", target, roomName, moderator)
+	case "unmute":
+		text = fmt.Sprintf("user '%s' was unmuted in the '%s' room by '%s'", target, roomName, moderator)
+	}
+	if expiry != "" {
+		if t, err := time.Parse(time.RFC3339Nano, expiry); err == nil {
+			text += " until " + t.Local().Format(timestampFormat)
+		}
+	}
+	if reason != "" {
+		text += ": " + reason
+	}
+	return text
+}
@@ -0,0 +1,86 @@
+package main
+
+// Maximum number of messages held for a disconnected user.
+const maxPendingMessages = 200
+
+// Request types which are only ever written to the journal by the server to
+// record outcomes which depend on connected sessions, and so cannot be
+// reproduced by replaying the original request.
+var internalRequests = map[string]bool{
+	"queue_msg":     true,
+	"clear_pending": true,
+}
+
+// Record a server generated request in the journal.
+func (req *MessageRequest) journal(entry Message) {
+	if req.replay || activeJournal == nil {
+		return
+	}
+	logStoreError(activeJournal.Append(entry))
+}
+
+// Hold a message for a user with no connected sessions until one connects.
+func (req *MessageRequest) queueMessage(userID UUID, msg Message) {
+	if req.replay {
+		// the journal holds a separate entry for the queued message
+		return
+	}
+	addPending(userID, msg)
+	req.journal(Message{Type: "queue_msg", TargetUUID: userID, Messages: []Message{msg}})
+}
+
+// Send a room message to every session of all users in the room, holding it
+// for members who are disconnected so they can catch up when they reconnect.
+func (req *MessageRequest) broadcast(r *room, msg Message) {
+	for _, id := range store.Members(r.Name) {
+		req.sendOrQueue(id, msg)
+	}
+}
+
+// Send a message to every session of a user, or hold it until they next
+// connect if they have none.
+func (req *MessageRequest) sendOrQueue(userID UUID, msg Message) {
+	if len(sessions[userID]) > 0 {
+		sendToUser(userID, msg)
+	} else {
+		req.queueMessage(userID, msg)
+	}
+}
+
+// Deliver all messages held for a user to the request's connection.
+func (req *MessageRequest) deliverPending(userID UUID) {
+	u, ok := store.User(userID)
+	if !ok || len(u.Pending) == 0 {
+		return
+	}
+
+	for _, msg := range u.Pending {
+		msg.marshalRequestToChan(req.out)
+	}
+	clearPending(userID)
+	req.journal(Message{Type: "clear_pending", TargetUUID: userID})
+}
+
+// Append messages to a user's pending messages, discarding the oldest once
+// the limit is reached.
+func addPending(userID UUID, msgs ...Message) {
+	u, ok := store.User(userID)
+	if !ok {
+		return
+	}
+	u.Pending = append(u.Pending, msgs...)
+	if len(u.Pending) > maxPendingMessages {
+		u.Pending = u.Pending[len(u.Pending)-maxPendingMessages:]
+	}
+	logStoreError(store.SaveUser(userID, u))
+}
+
+// Remove all of a user's pending messages.
+func clearPending(userID UUID) {
+	u, ok := store.User(userID)
+	if !ok {
+		return
+	}
+	u.Pending = nil
+	logStoreError(store.SaveUser(userID, u))
+}
@@ -0,0 +1,96 @@
+package main
+
+import "time"
+
+// User presence statuses. Away & do not disturb are set manually by users,
+// while online & offline follow whether the user has any sessions.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusDND     = "dnd"
+	StatusOffline = "offline"
+)
+
+// Connectionless (UDP) sessions are dropped once no request has been received
+// for the timeout. Sessions are checked for expiry every sweep interval.
+const (
+	sessionTimeout       = 3 * time.Minute
+	sessionSweepInterval = 30 * time.Second
+)
+
+// The presence status & role of a room member.
+type presence struct {
+	Username string
+	Status   string
+	Role     string
+}
+
+// Get the presence status of a user.
+func (u *user) PresenceStatus() string {
+	if u.Online == false {
+		return StatusOffline
+	}
+	if u.Status != "" {
+		return u.Status
+	}
+	return StatusOnline
+}
+
+// Check if a manually set presence status is supported.
+func validStatus(status string) bool {
+	return status == StatusOnline || status == StatusAway || status == StatusDND
+}
+
+// Mark a user as online or offline and notify the members of their rooms.
+func setOnline(userID UUID, online bool) {
+	u, ok := store.User(userID)
+	if !ok || u.Online == online {
+		return
+	}
+	u.Online = online
+	logStoreError(store.SaveUser(userID, u))
+	broadcastPresence(userID, u)
+}
+
+// Send a user's presence status to every member of the rooms they belong to,
+// including the user's own sessions.
+func broadcastPresence(userID UUID, u *user) {
+	msg := Message{Type: "status", Username: u.Name, Status: u.PresenceStatus(), DateTime: GetTimestamp()}
+
+	notified := map[UUID]bool{userID: true}
+	sendToUser(userID, msg)
+	for _, name := range store.RoomNames() {
+		if store.IsMember(name, userID) == false {
+			continue
+		}
+		for _, id := range store.Members(name) {
+			if notified[id] == false {
+				notified[id] = true
+				sendToUser(id, msg)
+			}
+		}
+	}
+}
+
+// Get the presence status & role of each member of a room.
+func roomPresence(r *room) []presence {
+	members := []presence{}
+	for _, id := range store.Members(r.Name) {
+		if u, ok := store.User(id); ok {
+			members = append(members, presence{Username: u.Name, Status: u.PresenceStatus(), Role: r.Role(id)})
+		}
+	}
+	return members
+}
+
+// Mark all users offline. No sessions exist on startup, so users left online
+// by a previous run are stale.
+func resetPresence() {
+	for _, id := range store.UserIDs() {
+		u, ok := store.User(id)
+		if ok && u.Online {
+			u.Online = false
+			logStoreError(store.SaveUser(id, u))
+		}
+	}
+}
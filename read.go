@@ -0,0 +1,50 @@
+package main
+
+// Move a user's last read position in a room forward to a message sequence
+// number. False is returned if the position would not move forward.
+func (u *user) MarkRead(roomName string, seq uint64) bool {
+	if seq <= u.LastRead[roomName] {
+		return false
+	}
+	if u.LastRead == nil {
+		u.LastRead = make(map[string]uint64)
+	}
+	u.LastRead[roomName] = seq
+	return true
+}
+
+// Get the number of chat messages in a room from other users which a user
+// has not read.
+func unreadCount(roomName string, u *user) int {
+	count := 0
+	for _, msg := range store.Messages(roomName) {
+		if msg.Seq > u.LastRead[roomName] && msg.Type == "new_msg" && msg.Deleted == false && msg.Username != u.Name {
+			count++
+		}
+	}
+	return count
+}
+
+// Get the sequence number of the latest message in a room.
+func latestSeq(roomName string) uint64 {
+	msgs := store.Messages(roomName)
+	if len(msgs) == 0 {
+		return 0
+	}
+	return msgs[len(msgs)-1].Seq
+}
+
+// Forget every user's read position in a destroyed room, so a new room by
+// the same name starts unread.
+func clearReadPositions(roomName string) {
+	for _, id := range store.UserIDs() {
+		u, ok := store.User(id)
+		if !ok {
+			continue
+		}
+		if _, ok := u.LastRead[roomName]; ok {
+			delete(u.LastRead, roomName)
+			logStoreError(store.SaveUser(id, u))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import "fmt"
+
+// Room roles. A room's creator is always an owner and other members are
+// members unless granted another role.
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read_only"
+)
+
+// Room permissions.
+const (
+	PermRead        = "read"         // read the room & delete own messages
+	PermPost        = "post"         // send, edit & react to messages and show typing
+	PermModerate    = "moderate"     // edit & delete other users' messages and view the audit log
+	PermKick        = "kick"         // remove & ban other users from the room
+	PermMute        = "mute"         // stop other users posting in the room
+	PermInvite      = "invite"       // invite users to join the room
+	PermTopic       = "topic"        // set the room's topic
+	PermSettings    = "settings"     // change the room's description & settings
+	PermManageRoles = "manage_roles" // grant & revoke roles
+	PermDestroy     = "destroy"      // destroy the room
+)
+
+// The permissions held by each room role.
+var rolePermissions = map[string]map[string]bool{
+	RoleOwner:     {PermRead: true, PermPost: true, PermModerate: true, PermKick: true, PermMute: true, PermInvite: true, PermTopic: true, PermSettings: true, PermManageRoles: true, PermDestroy: true},
+	RoleModerator: {PermRead: true, PermPost: true, PermModerate: true, PermKick: true, PermMute: true, PermInvite: true, PermTopic: true},
+	RoleMember:    {PermRead: true, PermPost: true},
+	RoleReadOnly:  {PermRead: true},
+}
+
+// The room permission required by each request type. These are checked
+// before the request is processed.
+var requestPermissions = map[string]string{
+	"new_msg":           PermPost,
+	"edit_msg":          PermPost,
+	"delete_msg":        PermRead,
+	"react":             PermPost,
+	"unreact":           PermPost,
+	"typing":            PermPost,
+	"invite":            PermInvite,
+	"kick":              PermKick,
+	"ban":               PermKick,
+	"unban":             PermKick,
+	"mute":              PermMute,
+	"unmute":            PermMute,
+	"audit":             PermModerate,
+	"set_topic":         PermTopic,
+	"set_room_settings": PermSettings,
+	"grant_role":        PermManageRoles,
+	"revoke_role":       PermManageRoles,
+	"destroy":           PermDestroy,
+}
+
+// The seniority of each room role. Users can only be moderated by those with a
+// more senior role.
+var roleRanks = map[string]int{
+	RoleOwner:     3,
+	RoleModerator: 2,
+	RoleMember:    1,
+	RoleReadOnly:  0,
+}
+
+// Check if a role is supported.
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Get a user's role in a room, or an empty string if they are not a member.
+func (r *room) Role(userID UUID) string {
+	if userID == r.Creator {
+		return RoleOwner
+	}
+	if r.IsUserSubscribed(userID) == false {
+		return ""
+	}
+	if role, ok := r.Roles[userID]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// Check if a user's role in a room is more senior than another's. Users who
+// are not members rank below all roles.
+func (r *room) Outranks(userID UUID, otherID UUID) bool {
+	rank, otherRank := -1, -1
+	if role := r.Role(userID); role != "" {
+		rank = roleRanks[role]
+	}
+	if role := r.Role(otherID); role != "" {
+		otherRank = roleRanks[role]
+	}
+	return rank > otherRank
+}
+
+// Check if a user's role in a room grants a permission.
+func (r *room) Can(userID UUID, perm string) bool {
+	return rolePermissions[r.Role(userID)][perm]
+}
+
+// Check that a user's role in a room grants a permission, describing why not
+// if it does not.
+func (r *room) CheckPermission(userID UUID, perm string) error {
+	role := r.Role(userID)
+	if role == "" {
+		return fmt.Errorf("user is not subscribed to this room.")
+	}
+	if rolePermissions[role][perm] == false {
+		return fmt.Errorf("the %s role does not have the '%s' permission in this room", role, perm)
+	}
+	return nil
+}
+
+// Set a member's role in a room. The role is kept if they leave and rejoin.
+func (r *room) SetRole(userID UUID, role string) {
+	if role == RoleMember {
+		delete(r.Roles, userID)
+	} else {
+		if r.Roles == nil {
+			r.Roles = make(map[UUID]string)
+		}
+		r.Roles[userID] = role
+	}
+	logStoreError(store.SaveRoom(r))
+}
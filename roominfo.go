@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest room topic & description accepted, in characters.
+const (
+	maxTopicLength       = 200
+	maxDescriptionLength = 1000
+)
+
+// Messages older than a room's retention period are discarded every sweep
+// interval.
+const retentionSweepInterval = time.Minute
+
+// The descriptive information & settings of a chat room.
+type roomInfo struct {
+	Name        string
+	Topic       string
+	Description string
+	Creator     string
+	Created     string
+	Private     bool
+	Members     int
+	MaxMembers  int    // zero if unlimited
+	Retention   string // duration messages are kept for, empty if forever
+}
+
+// Room list filters.
+const (
+	ListAll     = "all"
+	ListJoined  = "joined"
+	ListPublic  = "public"
+	ListPrivate = "private"
+)
+
+// A room listed by a list request. The unread message count is only given
+// for joined rooms.
+type roomSummary struct {
+	Name    string
+	Members int
+	Topic   string
+	Private bool
+	Joined  bool
+	Unread  int
+}
+
+// Check if a room list filter is supported. No filter lists all rooms.
+func validListFilter(filter string) bool {
+	return filter == "" || filter == ListAll || filter == ListJoined || filter == ListPublic || filter == ListPrivate
+}
+
+// Get a summary of each room visible to a user which matches a filter and
+// has a name starting with a prefix (ignoring case), in order of name.
+func listRooms(userID UUID, u *user, filter string, prefix string) []roomSummary {
+	rooms := []roomSummary{}
+	prefix = strings.ToLower(prefix)
+	for _, name := range VisibleRoomNames(userID) {
+		r, ok := store.Room(name)
+		if !ok || strings.HasPrefix(strings.ToLower(name), prefix) == false {
+			continue
+		}
+		joined := r.IsUserSubscribed(userID)
+		if (filter == ListJoined && joined == false) || (filter == ListPublic && r.Private) || (filter == ListPrivate && r.Private == false) {
+			continue
+		}
+
+		summary := roomSummary{Name: name, Members: len(store.Members(name)), Topic: r.Topic, Private: r.Private, Joined: joined}
+		if joined {
+			summary.Unread = unreadCount(name, u)
+		}
+		rooms = append(rooms, summary)
+	}
+	return rooms
+}
+
+// Get the information & settings of a room.
+func (r *room) Info() *roomInfo {
+	info := &roomInfo{
+		Name:        r.Name,
+		Topic:       r.Topic,
+		Description: r.Description,
+		Created:     r.Created,
+		Private:     r.Private,
+		Members:     len(store.Members(r.Name)),
+		MaxMembers:  r.MaxMembers,
+		Retention:   r.Retention,
+	}
+	if u, ok := store.User(r.Creator); ok {
+		info.Creator = u.Name
+	}
+	return info
+}
+
+// Check if a room has reached its maximum number of members.
+func (r *room) IsFull() bool {
+	return r.MaxMembers > 0 && len(store.Members(r.Name)) >= r.MaxMembers
+}
+
+// Validate a room topic.
+func validateTopic(topic string) error {
+	if utf8.RuneCountInString(topic) > maxTopicLength {
+		return fmt.Errorf("topic must not be longer than %d characters", maxTopicLength)
+	}
+	return nil
+}
+
+// Validate requested room settings. A retention of zero is treated as keeping
+// messages forever.
+func validateSettings(settings *roomInfo) error {
+	if utf8.RuneCountInString(settings.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must not be longer than %d characters", maxDescriptionLength)
+	}
+	if settings.MaxMembers < 0 {
+		return fmt.Errorf("maximum member count must not be negative")
+	}
+	if settings.Retention != "" {
+		d, err := time.ParseDuration(settings.Retention)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid retention - use a duration such as 720h, or 0 to keep messages forever")
+		}
+		if d == 0 {
+			settings.Retention = ""
+		}
+	}
+	return nil
+}
+
+// Change a room's description & settings.
+func (r *room) SetSettings(settings roomInfo) {
+	r.Description = settings.Description
+	r.MaxMembers = settings.MaxMembers
+	r.Retention = settings.Retention
+	logStoreError(store.SaveRoom(r))
+}
+
+// Discard the content of chat messages which are older than their room's
+// retention period, leaving tombstones so message sequence numbers are kept.
+func applyRetention() {
+	now := time.Now()
+	for _, name := range store.RoomNames() {
+		r, ok := store.Room(name)
+		if !ok || r.Retention == "" {
+			continue
+		}
+		retention, err := time.ParseDuration(r.Retention)
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range store.Messages(name) {
+			if msg.Type != "new_msg" || msg.Deleted {
+				continue
+			}
+			t, err := messageTime(msg)
+			if err != nil || now.Sub(t) < retention {
+				continue
+			}
+			msg.Deleted = true
+			msg.Text = ""
+			msg.Revisions = nil
+			msg.Reactions = nil
+			r.UpdateMessage(msg)
+		}
+	}
+}
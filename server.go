@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"log"
@@ -9,6 +10,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/twinj/uuid"
 )
 
 // Supported service Protocol types.
@@ -18,6 +24,7 @@ const (
 	TCP  Protocol = "tcp"
 	UDP  Protocol = "udp"
 	HTTP Protocol = "http"
+	WS   Protocol = "ws"
 )
 
 // Server types.
@@ -30,26 +37,55 @@ type TCPServer Server
 type UDPServer Server
 
 func NewServer(host string, port int) error {
-	// populate server data stores from file
-	err := unpackChatServer()
+	workingDir, err := os.Getwd()
 	if err != nil {
-		log.Println(err.Error())
+		return err
 	}
 
-	// create example rooms
-	NewRoom("room_1", UUID("admin"))
-	NewRoom("room_2", UUID("admin"))
+	// open the selected data store
+	store, err = openStore(*storeBackend, workingDir+"/data")
+	if err != nil {
+		return err
+	}
 
+	// the memory store is made durable by snapshots and the request journal
+	if memStore, ok := store.(*memoryStore); ok {
+		err = recoverMemoryStore(memStore, workingDir+"/data")
+		if err != nil {
+			return err
+		}
+	} else if len(store.RoomNames()) == 0 && len(store.UserIDs()) == 0 {
+		// a new database
+		createExampleRooms()
+	}
+
+	// nobody is connected yet
+	resetPresence()
+
+	// load key for signing session tokens
+	tokenKey, err = loadTokenKey(workingDir + "/data/token.key")
+	if err != nil {
+		return err
+	}
+
+	requestPool = make(chan MessageRequest)
 	go requestPoller()
 
-	// start TCP & UDP servers
+	// start TCP, UDP & WebSocket servers
 	ts := &TCPServer{host, port, make(chan struct{}, 1)}
 	us := &UDPServer{host, port, make(chan struct{}, 1)}
+	ws := &WSServer{host, *wsPort, make(chan struct{}, 1)}
 
 	// return first error to caller
 	var errors chan error
 	go ts.Start(errors)
-	go us.Start(errors)
+	go ws.Start(errors)
+	// UDP traffic cannot be encrypted so it is not served alongside TLS
+	if *useTLS {
+		log.Printf("UDP server disabled as TLS is enabled")
+	} else {
+		go us.Start(errors)
+	}
 
 	// continuously process stdin console input
 	func() {
@@ -60,6 +96,11 @@ func NewServer(host string, port int) error {
 			case "exit":
 				ts.exit <- struct{}{}
 				us.exit <- struct{}{}
+				ws.exit <- struct{}{}
+				if activeJournal != nil {
+					logStoreError(activeJournal.Close())
+				}
+				logStoreError(store.Close())
 				errors <- nil
 				return
 			}
@@ -79,6 +120,18 @@ func (s *TCPServer) Start(errors chan error) {
 	}
 	log.Printf("starting TCP server on port %d", s.port)
 
+	// wrap listener to perform TLS handshakes
+	if *useTLS {
+		config, err := serverTLSConfig()
+		if err != nil {
+			listener.Close()
+			errors <- err
+			return
+		}
+		listener = tls.NewListener(listener, config)
+		log.Printf("TLS enabled on TCP server")
+	}
+
 	// listen for new connections
 	go func() {
 		for {
@@ -104,7 +157,6 @@ func (s *TCPServer) handleConn(conn net.Conn) {
 
 	// outgoing client messages
 	ch := make(chan string)
-	defer close(ch)
 
 	// send any new msg through connection
 	go s.clientWriter(conn, ch)
@@ -114,23 +166,25 @@ func (s *TCPServer) handleConn(conn net.Conn) {
 	fmt.Println(clientAddress + " TCP client connection established")
 
 	// scan input from connection
-	var clientUUID UUID
+	sess := newSession(ch)
 	input := bufio.NewScanner(conn)
 	for input.Scan() {
 		// unmarshal client string request into Message object
 		msg := Message{}
 		msg.unmarshalRequest(input.Text())
-		clientUUID = msg.TargetUUID
 
 		// produce response based on request
-		requestPool <- MessageRequest{&msg, ch}
+		requestPool <- MessageRequest{msg: &msg, out: ch, session: sess, creds: prepareCredentials(&msg)}
 	}
 
-	// client disconnecting
+	// client disconnecting, the exit is always sent as the session is only
+	// read by the request poller
 	fmt.Println(clientAddress + " TCP client connection dropped")
-	// broadcast user leaving message to all room users
-	exitMsg := Message{TargetUUID: clientUUID, Type: "exit"}
-	requestPool <- MessageRequest{msg: &exitMsg}
+	exitMsg := Message{Type: "exit"}
+	requestPool <- MessageRequest{msg: &exitMsg, session: sess}
+
+	// requests accepted before the exit have been processed, so nothing else writes to the channel
+	close(ch)
 }
 
 // Pull new TCP messages from channel to connection.
@@ -161,21 +215,45 @@ func (s *UDPServer) Start(errors chan error) {
 
 	// constantly poll for udp requests
 	go func() {
+		// clients by remote address, as UDP has no connections
+		clients := make(map[string]*udpClient)
+		lastSweep := time.Now()
+
 		for {
-			// read from UDP connection to buffer
+			// read from UDP connection to buffer, waking periodically to drop
+			// idle clients
+			listener.SetReadDeadline(time.Now().Add(sessionSweepInterval))
 			buffer := make([]byte, 2048)
 			n, remoteAddr, err := listener.ReadFromUDP(buffer)
+			if time.Since(lastSweep) >= sessionSweepInterval {
+				s.expireClients(clients)
+				lastSweep = time.Now()
+			}
 			// read error
 			if err != nil {
-				log.Print(err)
+				if netErr, ok := err.(net.Error); !ok || netErr.Timeout() == false {
+					log.Print(err)
+				}
 				continue
 			}
 
 			// create string from byte array buffer
 			request := string(buffer[:n])
 
+			// start a session & response writer for new clients
+			client, ok := clients[remoteAddr.String()]
+			if !ok {
+				ch := make(chan string)
+				go s.clientWriter(listener, remoteAddr, ch)
+				client = &udpClient{session: newSession(ch)}
+				client.session.connectionless = true
+				clients[remoteAddr.String()] = client
+			}
+			client.lastSeen = time.Now()
+
 			// handle request
-			go s.handleConn(listener, remoteAddr, request)
+			client.inflight.Add(1)
+			go s.handleConn(client, remoteAddr, request)
 		}
 	}()
 
@@ -183,13 +261,17 @@ func (s *UDPServer) Start(errors chan error) {
 	errors <- nil
 }
 
-// Process newly accepted UDP connection and associated client.
-func (s *UDPServer) handleConn(conn *net.UDPConn, addr *net.UDPAddr, request string) {
-	// outgoing client messages
-	ch := make(chan string)
+// A UDP client's session, along with a count of the requests received from it
+// which have not yet reached the request poller.
+type udpClient struct {
+	session  *session
+	lastSeen time.Time
+	inflight sync.WaitGroup
+}
 
-	// send response to client
-	go s.clientWriter(conn, addr, ch)
+// Process a UDP request from a client.
+func (s *UDPServer) handleConn(client *udpClient, addr *net.UDPAddr, request string) {
+	defer client.inflight.Done()
 
 	// get client address
 	fmt.Println(addr.String() + " UDP client request received")
@@ -198,8 +280,28 @@ func (s *UDPServer) handleConn(conn *net.UDPConn, addr *net.UDPAddr, request str
 	msg := Message{}
 	msg.unmarshalRequest(request)
 
-	// produce response based on request
-	requestPool <- MessageRequest{&msg, ch}
+	// produce response based on request, authenticating with the request token
+	sess := client.session
+	requestPool <- MessageRequest{msg: &msg, out: sess.out, session: sess, creds: prepareCredentials(&msg)}
+}
+
+// Drop clients which have not sent a request within the session timeout, as
+// no disconnect is ever seen for them. Once the requests already received from
+// a client are processed its session is ended and its response writer stopped.
+func (s *UDPServer) expireClients(clients map[string]*udpClient) {
+	for addr, client := range clients {
+		if time.Since(client.lastSeen) <= sessionTimeout {
+			continue
+		}
+		delete(clients, addr)
+
+		go func(client *udpClient) {
+			client.inflight.Wait()
+			exitMsg := Message{Type: "exit"}
+			requestPool <- MessageRequest{msg: &exitMsg, session: client.session}
+			close(client.session.out)
+		}(client)
+	}
 }
 
 // Push new UDP messages from channel to connection.
@@ -211,73 +313,363 @@ func (s *UDPServer) clientWriter(conn *net.UDPConn, addr *net.UDPAddr, ch <-chan
 		}
 	}
 
-	// client disconnecting
-	fmt.Println(addr.String() + " UDP response transmitted to client")
+	// client session expired
+	fmt.Println(addr.String() + " UDP client session expired")
 }
 
 // A message request format accepted by the request poller.
 type MessageRequest struct {
-	msg *Message
-	out chan string
+	msg     *Message
+	out     chan string
+	session *session
+	replay  bool
+	creds   *credentials
 }
 
 var requestPool chan MessageRequest
 
-// Poll for requests to process.
+// Poll for requests to process and perform periodic journal maintenance.
 func requestPoller() {
-	requestPool = make(chan MessageRequest)
+	syncTicker := time.NewTicker(journalSyncInterval)
+	defer syncTicker.Stop()
+	compactTicker := time.NewTicker(journalCompactInterval)
+	defer compactTicker.Stop()
+	typingTicker := time.NewTicker(typingSweepInterval)
+	defer typingTicker.Stop()
+	retentionTicker := time.NewTicker(retentionSweepInterval)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case currentRequest := <-requestPool:
+			currentRequest.processRequest()
+			if activeJournal != nil && activeJournal.NeedsCompaction() {
+				compactJournal()
+			}
+
+		// provide stored password hashes for connections to check logins against
+		case lookup := <-hashLookups:
+			var hash []byte
+			if _, u, ok := FindUserByName(lookup.name); ok {
+				hash = u.PasswordHash
+			}
+			lookup.reply <- hash
+
+		// flush journal writes for the interval fsync policy
+		case <-syncTicker.C:
+			if activeJournal == nil {
+				continue
+			}
+			err := activeJournal.Sync()
+			if err != nil {
+				log.Println(err.Error())
+			}
+
+		// snapshot server state so the journal does not grow unbounded
+		case <-compactTicker.C:
+			compactJournal()
+
+		// stop typing notifications which were not refreshed
+		case <-typingTicker.C:
+			expireTyping()
+
+		// discard messages older than their room's retention period
+		case <-retentionTicker.C:
+			applyRetention()
+		}
+	}
+}
 
-	for currentRequest := range requestPool {
-		currentRequest.processRequest()
+// Record an accepted state changing request in the journal. The server
+// timestamps and message ID of the response are stored with the request so
+// replaying it reproduces the original messages.
+func (req *MessageRequest) commit(freshMsg Message) {
+	if req.replay || activeJournal == nil {
+		return
+	}
+
+	entry := *req.msg
+	entry.DateTime, entry.Timestamp = freshMsg.DateTime, freshMsg.Timestamp
+	entry.ID = freshMsg.ID
+	req.journal(entry)
+}
+
+// Get the ID of a message stored by the request. Replayed requests reuse the
+// ID recorded in the journal so stored messages keep the same IDs.
+func (req *MessageRequest) messageID() UUID {
+	if req.replay && req.msg.ID != "" {
+		return req.msg.ID
+	}
+	return UUID(uuid.NewV4().String())
+}
+
+// Bind a user to the request's connection session and issue the client a
+// token for connectionless requests along with its user ID.
+func (req *MessageRequest) authenticate(userID UUID, freshMsg *Message) {
+	if req.session == nil {
+		return
+	}
+	if req.session.authenticated == false {
+		req.session.bind(userID)
+	}
+	freshMsg.Token = issueToken(userID)
+	freshMsg.TargetUUID = userID
+}
+
+// Snapshot server state and discard the journal segments it covers.
+func compactJournal() {
+	if activeJournal == nil {
+		return
+	}
+	memStore := store.(*memoryStore)
+	err := activeJournal.Compact(func(checkpoint int) error {
+		return storeChatServer(memStore, checkpoint)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Create the example rooms of a new server.
+func createExampleRooms() {
+	NewRoom("room_1", UUID("admin"), false)
+	NewRoom("room_2", UUID("admin"), false)
+}
+
+// Load the memory store from the last snapshot and replay the requests
+// journaled since it was taken, then begin journaling new requests.
+func recoverMemoryStore(memStore *memoryStore, dataDir string) error {
+	checkpoint, err := unpackChatServer(memStore)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	// a new server has neither a snapshot nor a journal, its example rooms are
+	// snapshotted straight away so they are restored like any other room
+	_, statErr := os.Stat(dataDir + "/rooms.dat")
+	segments, _ := listSegments(dataDir + "/journal")
+	if os.IsNotExist(statErr) && len(segments) == 0 {
+		createExampleRooms()
+		err = storeChatServer(memStore, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	j, pending, err := openJournal(dataDir+"/journal", *fsyncPolicy, checkpoint)
+	if err != nil {
+		return err
 	}
+	for i := range pending {
+		req := MessageRequest{msg: &pending[i], replay: true}
+		req.processRequest()
+	}
+	log.Printf("replayed %d journaled requests", len(pending))
+	activeJournal = j
+
+	return nil
 }
 
 // Direct requests to corresponding methods.
 func (req *MessageRequest) processRequest() {
 	staleMsg := req.msg
-	freshMsg := Message{Type: staleMsg.Type, Room: staleMsg.Room, DateTime: GetTimestamp()}
+	now := time.Now()
+	freshMsg := Message{Type: staleMsg.Type, Room: staleMsg.Room, DateTime: now.Format(timestampFormat), Timestamp: now.Format(time.RFC3339Nano)}
+	if req.replay {
+		freshMsg.DateTime, freshMsg.Timestamp = staleMsg.DateTime, staleMsg.Timestamp
+		// replayed requests are processed as of the time they were made
+		if t, err := time.Parse(time.RFC3339Nano, staleMsg.Timestamp); err == nil {
+			now = t
+		}
+	}
+
+	// take credentials out of the request so they are never stored or journaled
+	secret, token := staleMsg.Secret, staleMsg.Token
+	staleMsg.Secret, staleMsg.Token = "", ""
+
+	// client connection dropped, sent for every connection whether or not it
+	// logged in so the connection's channel is only closed once all of its
+	// requests are processed. The user remains subscribed to their rooms, which
+	// hold messages for them until they reconnect.
+	if staleMsg.Type == "exit" {
+		if req.session != nil {
+			req.session.unbind()
+		}
+		return
+	}
+
+	// authenticate the request against its connection session
+	if req.session != nil {
+		// anyone able to send from a connectionless session's address could
+		// make requests as its user, so each request must carry the token
+		if req.session.connectionless && token == "" && staleMsg.Type != "set_name" && staleMsg.Type != "login" {
+			freshMsg.Error = "a token is required with each UDP request"
+			freshMsg.marshalRequestToChan(req.out)
+			return
+		}
+
+		if token != "" {
+			userID, err := verifyToken(token)
+			if err == nil && req.session.authenticated && userID != req.session.userID {
+				err = fmt.Errorf("token does not match the logged in user")
+			}
+			if err != nil {
+				freshMsg.Error = err.Error()
+				freshMsg.marshalRequestToChan(req.out)
+				return
+			}
+			if req.session.authenticated == false {
+				req.session.bind(userID)
+				req.deliverPending(userID)
+			}
+		}
+
+		if req.session.authenticated {
+			// identity is bound to the connection, reject requests claiming to be anyone else
+			if staleMsg.TargetUUID != "" && staleMsg.TargetUUID != req.session.userID {
+				freshMsg.Error = "request identity does not match the logged in user"
+				freshMsg.marshalRequestToChan(req.out)
+				return
+			}
+			staleMsg.TargetUUID = req.session.userID
+		} else if staleMsg.Type != "set_name" && staleMsg.Type != "login" {
+			freshMsg.Error = "not logged in - log in or set a user name first"
+			freshMsg.marshalRequestToChan(req.out)
+			return
+		}
+	}
+
+	// server generated request types are only accepted from the journal
+	if internalRequests[staleMsg.Type] && req.replay == false {
+		freshMsg.Error = "request type not recognised"
+		freshMsg.marshalRequestToChan(req.out)
+		return
+	}
 
 	// validate
-	if UserExists(staleMsg.TargetUUID) {
-		// update use references to output channel and msg username
-		users[staleMsg.TargetUUID].Out = req.out
-		freshMsg.Username = users[UUID(staleMsg.TargetUUID)].Name
+	u, userFound := store.User(staleMsg.TargetUUID)
+	if staleMsg.Type == "set_name" || staleMsg.Type == "login" {
+		// identity is established by the request itself
 
-	} else if staleMsg.Type != "set_name" {
+	} else if userFound {
+		freshMsg.Username = u.Name
+
+	} else {
 		// if user does not exist and request is not a 'create' request, then exit
 		freshMsg.Error = "no name is associated with client ID - set a user name first"
 		freshMsg.marshalRequestToChan(req.out)
 		return
 	}
 
+	// look up the room targeted by the request, treating private rooms the user
+	// cannot see as not existing
+	r, roomFound := store.Room(staleMsg.Room)
+	if roomFound && r.VisibleTo(staleMsg.TargetUUID) == false {
+		roomFound = false
+	}
+
+	// check the user's role in the room permits the request
+	if perm, ok := requestPermissions[staleMsg.Type]; ok && roomFound {
+		if err := r.CheckPermission(staleMsg.TargetUUID, perm); err != nil {
+			freshMsg.Error = err.Error()
+			freshMsg.marshalRequestToChan(req.out)
+			return
+		}
+	}
+
 	switch staleMsg.Type {
 
 	// join server for the first time
 	case "set_name":
-		NewUser(staleMsg.TargetUUID, staleMsg.Text, req.out)
+		if userFound {
+			freshMsg.Error = "a user with this client ID already exists - log in instead"
+			break
+		}
+		if staleMsg.TargetUUID == "" || strings.TrimSpace(staleMsg.Text) == "" {
+			freshMsg.Error = "a client ID and user name are required"
+			break
+		}
+		if _, _, taken := FindUserByName(staleMsg.Text); taken {
+			freshMsg.Error = "user name is already taken"
+			break
+		}
+		hash, err := req.hashSecret(secret)
+		if err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+
+		NewUser(staleMsg.TargetUUID, staleMsg.Text, hash)
+		req.authenticate(staleMsg.TargetUUID, &freshMsg)
 		log.Printf("user with UUID '%s' set their name to '%s'", staleMsg.TargetUUID, staleMsg.Text)
 		freshMsg.Text = fmt.Sprintf("user name successfully set to '%s'", staleMsg.Text)
+		freshMsg.Username = staleMsg.Text
 
-		// update user persistence file
-		err := storeChatServer()
-		if err != nil {
-			log.Println(err.Error())
+		// journal the password hash rather than the password
+		staleMsg.Secret = string(hash)
+		req.commit(freshMsg)
+
+	// authenticate the connection as an existing user
+	case "login":
+		userID, lu, found := FindUserByName(staleMsg.Username)
+		if found && req.session != nil && req.session.authenticated && req.session.userID != userID {
+			freshMsg.Error = "connection is already logged in as another user"
+			break
+		}
+		if found == false {
+			freshMsg.Error = "invalid user name or password"
+			break
 		}
 
-	// list all chat rooms
-	case "list":
-		i := 0
-		for k := range rooms {
-			freshMsg.Text += k
-			if i < len(rooms)-1 {
-				freshMsg.Text += ", "
+		if len(lu.PasswordHash) == 0 {
+			// users created before passwords were introduced set theirs on first
+			// login, proving who they are with the client ID they were known by
+			if staleMsg.TargetUUID != userID {
+				freshMsg.Error = "invalid user name or password"
+				break
 			}
-			i++
+			hash, err := req.hashSecret(secret)
+			if err != nil {
+				freshMsg.Error = err.Error()
+				break
+			}
+			lu.PasswordHash = hash
+			logStoreError(store.SaveUser(userID, lu))
+			log.Printf("user with UUID '%s' set their password", userID)
+
+			// journal the password hash rather than the password
+			staleMsg.TargetUUID = userID
+			staleMsg.Secret = string(hash)
+			req.commit(freshMsg)
+
+		} else if req.replay == false && req.secretMatches(lu.PasswordHash) == false {
+			freshMsg.Error = "invalid user name or password"
+			break
 		}
 
+		req.authenticate(userID, &freshMsg)
+		freshMsg.Text = fmt.Sprintf("logged in as '%s'", lu.Name)
+		freshMsg.Username = lu.Name
+
+		// respond before delivering messages held while the user was disconnected
+		freshMsg.marshalRequestToChan(req.out)
+		req.deliverPending(userID)
+		return
+
+	// list chat rooms, optionally only those joined, public or private and
+	// those with names starting with a prefix
+	case "list":
+		if validListFilter(staleMsg.Filter) == false {
+			freshMsg.Error = "unsupported filter - use all, joined, public or private"
+			break
+		}
+		freshMsg.Filter = staleMsg.Filter
+		freshMsg.Text = staleMsg.Text
+		freshMsg.Rooms = listRooms(staleMsg.TargetUUID, u, staleMsg.Filter, staleMsg.Text)
+
 	// create a chat room
 	case "create":
-		if RoomExists(staleMsg.Room) {
+		if roomFound {
 			freshMsg.Error = "room already exists"
 			break
 		}
@@ -286,103 +678,689 @@ func (req *MessageRequest) processRequest() {
 			freshMsg.Error = "room name must not contain white space"
 			break
 		}
+		// validate any requested topic & settings before creating the room
+		settings := roomInfo{}
+		if staleMsg.Info != nil {
+			settings = *staleMsg.Info
+		}
+		if err := validateTopic(settings.Topic); err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		if err := validateSettings(&settings); err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
 		// create room
-		NewRoom(staleMsg.Room, staleMsg.TargetUUID)
-		rooms[staleMsg.Room].creator = staleMsg.TargetUUID
+		r, err := NewRoom(staleMsg.Room, staleMsg.TargetUUID, staleMsg.Private)
+		if err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		r.Topic = settings.Topic
+		r.Created = freshMsg.Timestamp
+		r.SetSettings(settings)
+		freshMsg.ID = req.messageID()
+		freshMsg.Private = r.Private
 		freshMsg.Text = fmt.Sprintf("You have created the '%s' room", staleMsg.Room)
-		rooms[staleMsg.Room].messages = append(rooms[staleMsg.Room].messages, freshMsg)
+		if r.Private {
+			freshMsg.Text = fmt.Sprintf("You have created the private '%s' room", staleMsg.Room)
+		}
+		r.AddMessage(&freshMsg)
+		req.commit(freshMsg)
 
 	// destroy a chat room
 	case "destroy":
-		if RoomExists(staleMsg.Room) == false {
+		if roomFound == false {
 			freshMsg.Error = "specified room does not exist"
 			break
 		}
-		if rooms[staleMsg.Room].creator != staleMsg.TargetUUID {
-			freshMsg.Error = "only the creator of a room can destroy it"
-			break
-		}
-		// create room
-		freshMsg.Text = fmt.Sprintf("user '%s' destroyed the '%s' room", users[UUID(staleMsg.TargetUUID)].Name, staleMsg.Room)
-		rooms[staleMsg.Room].messages = append(rooms[staleMsg.Room].messages, freshMsg)
+		freshMsg.ID = req.messageID()
+		freshMsg.Text = fmt.Sprintf("user '%s' destroyed the '%s' room", u.Name, staleMsg.Room)
+		r.AddMessage(&freshMsg)
 
-		rooms[staleMsg.Room].Broadcast(freshMsg)
+		req.broadcast(r, freshMsg)
 		RemoveRoom(staleMsg.Room)
+		clearReadPositions(staleMsg.Room)
+		req.commit(freshMsg)
 		return
 
-	// join a chat room
-	case "join":
-		if RoomExists(staleMsg.Room) == false {
+	// join a chat room, or accept an invitation to join one
+	case "join", "accept_invite":
+		if roomFound == false {
 			freshMsg.Error = "specified room does not exist"
 			break
 		}
 		// check if user is subscribed to the room
-		if rooms[staleMsg.Room].IsUserSubscribed(staleMsg.TargetUUID) {
+		if r.IsUserSubscribed(staleMsg.TargetUUID) {
+			freshMsg.Error = "user is already subscribed to this room"
+			break
+		}
+		if staleMsg.Type == "accept_invite" && r.IsInvited(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "user has not been invited to this room"
+			break
+		}
+		if r.IsBanned(staleMsg.TargetUUID, now) {
+			freshMsg.Error = "user is banned from this room"
+			break
+		}
+		if r.IsFull() {
+			freshMsg.Error = "room has reached its maximum number of members"
+			break
+		}
+		// take the requested number of recent messages before the join notice is added
+		var recent []Message
+		if staleMsg.Limit > 0 {
+			recent, _ = historyPage(topLevelMessages(store.Messages(r.Name)), "", "", staleMsg.Limit)
+		}
+
+		r.AddUser(staleMsg.TargetUUID)
+		if r.IsInvited(staleMsg.TargetUUID) {
+			r.RemoveInvite(staleMsg.TargetUUID)
+		}
+		freshMsg.Type = "join"
+		freshMsg.ID = req.messageID()
+		freshMsg.Text = fmt.Sprintf("user '%s' added to the '%s' room", u.Name, staleMsg.Room)
+		r.AddMessage(&freshMsg)
+		req.commit(freshMsg)
+
+		req.broadcast(r, freshMsg)
+
+		// replay recent room messages to the joining client
+		if staleMsg.Limit > 0 {
+			historyMsg := Message{Type: "history", Room: r.Name, DateTime: freshMsg.DateTime, Username: u.Name, Messages: recent}
+			historyMsg.marshalRequestToChan(req.out)
+		}
+		return
+
+	// invite a user to join a chat room
+	case "invite":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		inviteeID, invitee, found := FindUserByName(staleMsg.Target)
+		if found == false {
+			freshMsg.Error = "specified user does not exist"
+			break
+		}
+		if inviteeID == staleMsg.TargetUUID {
+			freshMsg.Error = "cannot invite yourself to a room"
+			break
+		}
+		if r.IsUserSubscribed(inviteeID) {
 			freshMsg.Error = "user is already subscribed to this room"
 			break
 		}
-		rooms[staleMsg.Room].AddUser(staleMsg.TargetUUID)
-		freshMsg.Text = fmt.Sprintf("user '%s' added to the '%s' room", users[UUID(staleMsg.TargetUUID)].Name, staleMsg.Room)
-		rooms[staleMsg.Room].messages = append(rooms[staleMsg.Room].messages, freshMsg)
+		if r.IsInvited(inviteeID) {
+			freshMsg.Error = "user has already been invited to this room"
+			break
+		}
+		if r.IsBanned(inviteeID, now) {
+			freshMsg.Error = "user is banned from this room"
+			break
+		}
+		r.Invite(inviteeID)
+		freshMsg.Target = invitee.Name
+		freshMsg.Private = r.Private
+		freshMsg.Text = fmt.Sprintf("user '%s' invited '%s' to the '%s' room", u.Name, invitee.Name, r.Name)
+		req.commit(freshMsg)
+
+		// notify the invitee, or hold the invitation until they next connect
+		req.sendOrQueue(inviteeID, freshMsg)
+
+	// decline an invitation to join a chat room
+	case "decline_invite":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.IsInvited(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "user has not been invited to this room"
+			break
+		}
+		r.RemoveInvite(staleMsg.TargetUUID)
+		freshMsg.Text = fmt.Sprintf("user '%s' declined the invitation to the '%s' room", u.Name, r.Name)
+		req.commit(freshMsg)
+
+		// let the room's creator know
+		req.sendOrQueue(r.Creator, freshMsg)
+
+	// grant a room role to a member, or revoke it returning them to a member
+	case "grant_role", "revoke_role":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		role := RoleMember
+		if staleMsg.Type == "grant_role" {
+			role = staleMsg.Role
+		}
+		if validRole(role) == false {
+			freshMsg.Error = "unsupported role - use owner, moderator, member or read_only"
+			break
+		}
+		memberID, member, found := FindUserByName(staleMsg.Target)
+		if found == false || r.IsUserSubscribed(memberID) == false {
+			freshMsg.Error = "specified user is not subscribed to this room"
+			break
+		}
+		if memberID == r.Creator {
+			freshMsg.Error = "the role of the room's creator cannot be changed"
+			break
+		}
+		if r.Role(memberID) == role {
+			freshMsg.Error = fmt.Sprintf("user already has the %s role", role)
+			break
+		}
+		r.SetRole(memberID, role)
+		freshMsg.Target = member.Name
+		freshMsg.Role = role
+		freshMsg.Text = fmt.Sprintf("user '%s' gave '%s' the %s role in the '%s' room", u.Name, member.Name, role, r.Name)
+		req.commit(freshMsg)
+
+		req.broadcast(r, freshMsg)
+		return
+
+	// remove a member from a chat room, ban a user from joining it or stop a
+	// member posting in it, optionally for a duration
+	case "kick", "ban", "mute":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		targetID, target, found := FindUserByName(staleMsg.Target)
+		if found == false {
+			freshMsg.Error = "specified user does not exist"
+			break
+		}
+		subscribed := r.IsUserSubscribed(targetID)
+		if staleMsg.Type != "ban" && subscribed == false {
+			freshMsg.Error = "specified user is not subscribed to this room"
+			break
+		}
+		if r.Outranks(staleMsg.TargetUUID, targetID) == false {
+			freshMsg.Error = "cannot moderate a user whose role is equal to or more senior than yours"
+			break
+		}
+		var expiry string
+		if staleMsg.Type != "kick" {
+			var err error
+			expiry, err = sanctionExpiry(now, staleMsg.Duration)
+			if err != nil {
+				freshMsg.Error = err.Error()
+				break
+			}
+		}
+
+		switch staleMsg.Type {
+		case "ban":
+			r.Ban(targetID, expiry)
+		case "mute":
+			r.Mute(targetID, expiry)
+		}
+		freshMsg.Target = target.Name
+		freshMsg.Expires = expiry
+		freshMsg.Text = describeSanction(staleMsg.Type, u.Name, target.Name, r.Name, expiry, staleMsg.Text)
+		r.Audit(freshMsg)
+
+		// removed members leave the room, notified along with the rest of the room
+		if staleMsg.Type != "mute" && subscribed {
+			freshMsg.ID = req.messageID()
+			r.AddMessage(&freshMsg)
+			req.commit(freshMsg)
+			req.broadcast(r, freshMsg)
+			r.RemoveUser(targetID)
+			stopTyping(r.Name, targetID, target.Name)
+			return
+		}
+		req.commit(freshMsg)
+		req.broadcast(r, freshMsg)
+		if subscribed == false {
+			req.sendOrQueue(targetID, freshMsg)
+		}
+		return
+
+	// lift a user's ban from or mute in a chat room
+	case "unban", "unmute":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		targetID, target, found := FindUserByName(staleMsg.Target)
+		if found == false {
+			freshMsg.Error = "specified user does not exist"
+			break
+		}
+		if staleMsg.Type == "unban" {
+			if r.IsBanned(targetID, now) == false {
+				freshMsg.Error = "user is not banned from this room"
+				break
+			}
+			r.Unban(targetID)
+		} else {
+			if r.IsMuted(targetID, now) == false {
+				freshMsg.Error = "user is not muted in this room"
+				break
+			}
+			r.Unmute(targetID)
+		}
+		freshMsg.Target = target.Name
+		freshMsg.Text = describeSanction(staleMsg.Type, u.Name, target.Name, r.Name, "", staleMsg.Text)
+		r.Audit(freshMsg)
+		req.commit(freshMsg)
+
+		req.broadcast(r, freshMsg)
+		if r.IsUserSubscribed(targetID) == false {
+			req.sendOrQueue(targetID, freshMsg)
+		}
+		return
+
+	// get a chat room's information & settings
+	case "room_info":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		freshMsg.Info = r.Info()
+
+	// set a chat room's topic, or clear it if empty
+	case "set_topic":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		topic := strings.TrimSpace(staleMsg.Text)
+		if err := validateTopic(topic); err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		r.Topic = topic
+		logStoreError(store.SaveRoom(r))
+		freshMsg.Info = r.Info()
+		freshMsg.Text = fmt.Sprintf("user '%s' set the topic of the '%s' room to '%s'", u.Name, r.Name, topic)
+		if topic == "" {
+			freshMsg.Text = fmt.Sprintf("user '%s' cleared the topic of the '%s' room", u.Name, r.Name)
+		}
+		req.commit(freshMsg)
+
+		req.broadcast(r, freshMsg)
+		return
+
+	// change a chat room's description & settings
+	case "set_room_settings":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if staleMsg.Info == nil {
+			freshMsg.Error = "no room settings were specified"
+			break
+		}
+		settings := *staleMsg.Info
+		if err := validateSettings(&settings); err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		r.SetSettings(settings)
+		freshMsg.Info = r.Info()
+		freshMsg.Text = fmt.Sprintf("user '%s' changed the settings of the '%s' room", u.Name, r.Name)
+		req.commit(freshMsg)
 
-		rooms[staleMsg.Room].Broadcast(freshMsg)
+		req.broadcast(r, freshMsg)
 		return
 
+	// get a chat room's moderation audit log
+	case "audit":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		freshMsg.Messages = r.AuditLog
+
 	// leave chat room
 	case "leave":
-		if RoomExists(staleMsg.Room) == false {
+		if roomFound == false {
 			freshMsg.Error = "specified room does not exist"
 			break
 		}
 		// check if user is subscribed to the room
-		if rooms[staleMsg.Room].IsUserSubscribed(staleMsg.TargetUUID) == false {
+		if r.IsUserSubscribed(staleMsg.TargetUUID) == false {
 			freshMsg.Error = "user is not subscribed to this room."
 			break
 		}
-		freshMsg.Text = fmt.Sprintf("user '%s' removed from the '%s' room", users[UUID(staleMsg.TargetUUID)].Name, staleMsg.Room)
-		rooms[staleMsg.Room].messages = append(rooms[staleMsg.Room].messages, freshMsg)
+		freshMsg.ID = req.messageID()
+		freshMsg.Text = fmt.Sprintf("user '%s' removed from the '%s' room", u.Name, staleMsg.Room)
+		r.AddMessage(&freshMsg)
 
-		rooms[staleMsg.Room].Broadcast(freshMsg)
-		rooms[staleMsg.Room].RemoveUser(staleMsg.TargetUUID)
+		req.broadcast(r, freshMsg)
+		r.RemoveUser(staleMsg.TargetUUID)
+		req.commit(freshMsg)
 		return
 
 	// a standard message to server
 	case "new_msg":
-		if RoomExists(staleMsg.Room) == false {
+		if roomFound == false {
 			freshMsg.Error = "specified room does not exist"
 			break
 		}
 		// check if user is subscribed to the room
-		if rooms[staleMsg.Room].IsUserSubscribed(staleMsg.TargetUUID) == false {
+		if r.IsUserSubscribed(staleMsg.TargetUUID) == false {
 			freshMsg.Error = "user is not subscribed to this room."
 			break
 		}
+		if r.IsMuted(staleMsg.TargetUUID, now) {
+			freshMsg.Error = "user is muted in this room"
+			break
+		}
+		// replies are added to the thread of the referenced message
+		if staleMsg.ParentID != "" || staleMsg.ParentSeq != 0 {
+			parent, err := r.FindThreadParent(staleMsg.ParentID, staleMsg.ParentSeq)
+			if err != nil {
+				freshMsg.Error = err.Error()
+				break
+			}
+			if parent.Deleted {
+				freshMsg.Error = "cannot reply to a deleted message"
+				break
+			}
+			freshMsg.ParentID, freshMsg.ParentSeq = parent.ID, parent.Seq
+		}
 		// add msg to room records
-		rooms[staleMsg.Room].messages = append(rooms[staleMsg.Room].messages, freshMsg)
+		freshMsg.ID = req.messageID()
 		freshMsg.Text = staleMsg.Text
+		r.AddMessage(&freshMsg)
+		req.commit(freshMsg)
 
 		// broadcast to all clients subscribed to room
-		rooms[staleMsg.Room].Broadcast(freshMsg)
+		stopTyping(r.Name, staleMsg.TargetUUID, u.Name)
+		req.broadcast(r, freshMsg)
+		notifyMentions(r, freshMsg, staleMsg.TargetUUID)
 		return
 
-	// client connection dropped
-	case "exit":
-		// unsubscribe user from each room
-		for name := range rooms {
-			// check if user is subscribed to the current room
-			if rooms[name].IsUserSubscribed(staleMsg.TargetUUID) == false {
-				continue
+	// move the user's read position in a room up to a message, or the latest
+	// message if none is specified
+	case "mark_read":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.IsUserSubscribed(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "user is not subscribed to this room."
+			break
+		}
+		seq := latestSeq(r.Name)
+		if staleMsg.ID != "" || staleMsg.Seq != 0 {
+			target, found := r.FindMessage(staleMsg.ID, staleMsg.Seq)
+			if found == false {
+				freshMsg.Error = "specified message does not exist"
+				break
+			}
+			seq = target.Seq
+		}
+
+		freshMsg.Username = u.Name
+		if u.MarkRead(r.Name, seq) {
+			logStoreError(store.SaveUser(staleMsg.TargetUUID, u))
+			freshMsg.Seq = seq
+
+			// journal the resolved position, as the commit does not keep a
+			// requested message ID
+			staleMsg.Seq = seq
+			req.commit(freshMsg)
+
+			// send the new unread count to the user's sessions only, as read
+			// markers are sent far too often to share with the whole room
+			freshMsg.Unread = map[string]int{r.Name: unreadCount(r.Name, u)}
+			sendToUser(staleMsg.TargetUUID, freshMsg)
+			return
+		}
+		freshMsg.Seq = u.LastRead[r.Name]
+		freshMsg.Unread = map[string]int{r.Name: unreadCount(r.Name, u)}
+
+	// relay that the user started or stopped typing to the room's other subscribers
+	case "typing":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.IsUserSubscribed(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "user is not subscribed to this room."
+			break
+		}
+		if r.IsMuted(staleMsg.TargetUUID, now) {
+			freshMsg.Error = "user is muted in this room"
+			break
+		}
+		if staleMsg.Status == StatusStopped {
+			stopTyping(r.Name, staleMsg.TargetUUID, u.Name)
+		} else {
+			startTyping(r.Name, staleMsg.TargetUUID, u.Name)
+		}
+		return
+
+	// edit or delete a chat room message
+	case "edit_msg", "delete_msg":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		target, found := r.FindMessage(staleMsg.ID, staleMsg.Seq)
+		if found == false || target.Type != "new_msg" {
+			freshMsg.Error = "specified message does not exist"
+			break
+		}
+		if target.Username != u.Name && r.Can(staleMsg.TargetUUID, PermModerate) == false {
+			freshMsg.Error = "only the author of a message or a room moderator can modify it"
+			break
+		}
+		if target.Deleted {
+			freshMsg.Error = "message has been deleted"
+			break
+		}
+
+		if staleMsg.Type == "edit_msg" {
+			if r.IsMuted(staleMsg.TargetUUID, now) {
+				freshMsg.Error = "user is muted in this room"
+				break
+			}
+			if strings.TrimSpace(staleMsg.Text) == "" {
+				freshMsg.Error = "edited message must not be empty"
+				break
+			}
+			// keep the text being replaced in the edit history
+			target.Revisions = append(target.Revisions, revision{Text: target.Text, Timestamp: freshMsg.Timestamp})
+			target.Text = staleMsg.Text
+		} else {
+			// leave a tombstone in place of the message and its history
+			target.Deleted = true
+			target.Text = ""
+			target.Revisions = nil
+			target.Reactions = nil
+		}
+		r.UpdateMessage(target)
+		freshMsg.ID = target.ID
+		req.commit(freshMsg)
+
+		// broadcast the updated message, as made by the requesting user
+		update := target
+		update.Type = staleMsg.Type
+		update.Target = u.Name
+		req.broadcast(r, update)
+		return
+
+	// add or remove a reaction to a chat room message
+	case "react", "unreact":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.IsUserSubscribed(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "user is not subscribed to this room."
+			break
+		}
+		if staleMsg.Emoji == "" || utf8.RuneCountInString(staleMsg.Emoji) > maxEmojiLength || strings.ContainsAny(staleMsg.Emoji, " \t\n") {
+			freshMsg.Error = "invalid reaction emoji"
+			break
+		}
+		target, found := r.FindMessage(staleMsg.ID, staleMsg.Seq)
+		if found == false || target.Type != "new_msg" || target.Deleted {
+			freshMsg.Error = "specified message does not exist"
+			break
+		}
+
+		if staleMsg.Type == "react" {
+			if r.IsMuted(staleMsg.TargetUUID, now) {
+				freshMsg.Error = "user is muted in this room"
+				break
+			}
+			if target.AddReaction(staleMsg.Emoji, u.Name) == false {
+				freshMsg.Error = "you have already reacted with this emoji"
+				break
 			}
+		} else if target.RemoveReaction(staleMsg.Emoji, u.Name) == false {
+			freshMsg.Error = "you have not reacted with this emoji"
+			break
+		}
+		r.UpdateMessage(target)
+		freshMsg.ID = target.ID
+		req.commit(freshMsg)
+
+		// broadcast the message with its updated reactions
+		update := target
+		update.Type = staleMsg.Type
+		update.Target = u.Name
+		update.Emoji = staleMsg.Emoji
+		req.broadcast(r, update)
+		return
+
+	// send a direct message to another user
+	case "dm":
+		recipientID, recipient, found := FindUserByName(staleMsg.Target)
+		if found == false {
+			freshMsg.Error = "specified user does not exist"
+			break
+		}
+		if recipientID == staleMsg.TargetUUID {
+			freshMsg.Error = "cannot send a direct message to yourself"
+			break
+		}
+		freshMsg.ID = req.messageID()
+		freshMsg.Text = staleMsg.Text
+		freshMsg.Target = recipient.Name
+		logStoreError(store.AppendDirectMessage(staleMsg.TargetUUID, recipientID, &freshMsg))
+		req.commit(freshMsg)
+
+		// deliver to recipient, or hold the message until they next connect
+		req.sendOrQueue(recipientID, freshMsg)
+		// echo to all of the sender's sessions
+		sendToUser(staleMsg.TargetUUID, freshMsg)
+		return
+
+	// get the direct message history with another user
+	case "dm_history":
+		recipientID, recipient, found := FindUserByName(staleMsg.Target)
+		if found == false {
+			freshMsg.Error = "specified user does not exist"
+			break
+		}
+		freshMsg.Target = recipient.Name
+		freshMsg.Messages = store.DirectMessages(staleMsg.TargetUUID, recipientID)
+
+	// get a page of a chat room's message history
+	case "history":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.ReadableBy(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "private rooms can only be read by their members"
+			break
+		}
+		page, err := historyPage(topLevelMessages(store.Messages(r.Name)), staleMsg.Before, staleMsg.After, staleMsg.Limit)
+		if err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		freshMsg.Before, freshMsg.After = staleMsg.Before, staleMsg.After
+		freshMsg.Messages = page
+
+	// get a page of a message thread, starting with the message replied to
+	case "thread":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.ReadableBy(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "private rooms can only be read by their members"
+			break
+		}
+		parent, err := r.FindThreadParent(staleMsg.ID, staleMsg.Seq)
+		if err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		page, err := historyPage(threadMessages(store.Messages(r.Name), parent.ID), staleMsg.Before, staleMsg.After, staleMsg.Limit)
+		if err != nil {
+			freshMsg.Error = err.Error()
+			break
+		}
+		freshMsg.ID, freshMsg.Seq = parent.ID, parent.Seq
+		freshMsg.Before, freshMsg.After = staleMsg.Before, staleMsg.After
+		freshMsg.Messages = page
+
+	// set the user's manual presence status
+	case "set_status":
+		if validStatus(staleMsg.Status) == false {
+			freshMsg.Error = "status must be one of online, away or dnd"
+			break
+		}
+		u.Status = staleMsg.Status
+		if staleMsg.Status == StatusOnline {
+			u.Status = ""
+		}
+		logStoreError(store.SaveUser(staleMsg.TargetUUID, u))
+		req.commit(freshMsg)
+		broadcastPresence(staleMsg.TargetUUID, u)
+		return
 
-			// broadcast user leaving message to everyone in room
-			rooms[name].RemoveUser(staleMsg.TargetUUID)
-			freshMsg.Text = fmt.Sprintf("user '%s' removed from the '%s' room", users[UUID(staleMsg.TargetUUID)].Name, name)
-			freshMsg.Type = "leave"
-			freshMsg.Room = name
-			rooms[name].messages = append(rooms[name].messages, freshMsg)
+	// get the presence status of each member of a room
+	case "presence":
+		if roomFound == false {
+			freshMsg.Error = "specified room does not exist"
+			break
+		}
+		if r.ReadableBy(staleMsg.TargetUUID) == false {
+			freshMsg.Error = "private rooms can only be read by their members"
+			break
+		}
+		freshMsg.Members = roomPresence(r)
+
+	// keep a connectionless session alive
+	case "heartbeat":
+		return
 
-			rooms[name].Broadcast(freshMsg)
+	// get the user's unread mentions
+	case "mentions":
+		freshMsg.Messages = u.Mentions
+
+	// mark one or all of the user's mentions as read
+	case "clear_mentions":
+		if clearMentions(staleMsg.TargetUUID, staleMsg.ID) == false {
+			freshMsg.Error = "specified mention does not exist"
+			break
 		}
+		freshMsg.ID = staleMsg.ID
+		req.commit(freshMsg)
+
+	// hold a message for a disconnected user (journal only)
+	case "queue_msg":
+		addPending(staleMsg.TargetUUID, staleMsg.Messages...)
+		return
+
+	// messages held for a user were delivered (journal only)
+	case "clear_pending":
+		clearPending(staleMsg.TargetUUID)
 		return
 
 	default:
@@ -393,44 +1371,168 @@ func (req *MessageRequest) processRequest() {
 	freshMsg.marshalRequestToChan(req.out)
 }
 
-// Store server user and room data to file.
-func storeChatServer() error {
-	workingDir, err := os.Getwd()
+// A serialisable snapshot of a chat room used for persistence.
+type roomRecord struct {
+	UserIDs  map[UUID]bool
+	Messages []Message
+	Creator  UUID
+	Private  bool
+	Invited  map[UUID]bool
+	Roles    map[UUID]string
+	Banned   map[UUID]string
+	Muted    map[UUID]string
+	AuditLog []Message
+
+	Topic       string
+	Description string
+	Created     string
+	MaxMembers  int
+	Retention   string
+}
 
-	// create/truncate file for writing to
-	file, err := os.Create(workingDir + "/data/users.dat")
-	defer file.Close()
+// The persisted user, room and direct message data along with the journal
+// segment to resume replaying from. These are stored in the same file so they
+// are always consistent.
+type roomsSnapshot struct {
+	Users      map[UUID]*user
+	Rooms      map[string]roomRecord
+	Directs    map[string][]Message
+	Checkpoint int
+}
+
+// Store memory store user and room data to file, recording the journal
+// segment which holds the first request not covered by this snapshot.
+func storeChatServer(memStore *memoryStore, checkpoint int) error {
+	workingDir, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	// encode store map to file
-	encoder := gob.NewEncoder(file)
-	err = encoder.Encode(&users)
+	// convert rooms into their serialisable form and encode to file along with
+	// the users map
+	snapshot := roomsSnapshot{Users: memStore.users, Rooms: make(map[string]roomRecord, len(memStore.rooms)), Directs: memStore.directs, Checkpoint: checkpoint}
+	for name, r := range memStore.rooms {
+		snapshot.Rooms[name] = roomRecord{
+			UserIDs:  memStore.members[name],
+			Messages: memStore.messages[name],
+			Creator:  r.Creator,
+			Private:  r.Private,
+			Invited:  r.Invited,
+			Roles:    r.Roles,
+			Banned:   r.Banned,
+			Muted:    r.Muted,
+			AuditLog: r.AuditLog,
+
+			Topic:       r.Topic,
+			Description: r.Description,
+			Created:     r.Created,
+			MaxMembers:  r.MaxMembers,
+			Retention:   r.Retention,
+		}
+	}
+	err = writeGobFile(workingDir+"/data/rooms.dat", &snapshot)
 	if err != nil {
 		return err
 	}
 
+	// users were previously stored in a separate file, which is now superseded
+	err = os.Remove(workingDir + "/data/users.dat")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
-// Unpack server user and room data from file.
-func unpackChatServer() error {
+// Unpack user and room data from file into the memory store, returning the
+// journal segment to resume replaying from. Missing files are treated as
+// empty stores.
+func unpackChatServer(memStore *memoryStore) (int, error) {
 	workingDir, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
 
-	// open file to read from
-	file, err := os.Open(workingDir + "/data/users.dat")
-	defer file.Close()
+	// decode snapshot file contents and rebuild users & rooms
+	var snapshot roomsSnapshot
+	err = readGobFile(workingDir+"/data/rooms.dat", &snapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if snapshot.Users != nil {
+		memStore.users = snapshot.Users
+	} else {
+		// snapshots written before users were included in them leave users in
+		// their own file
+		err = readGobFile(workingDir+"/data/users.dat", &memStore.users)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	for name, record := range snapshot.Rooms {
+		memStore.rooms[name] = &room{
+			Name:     name,
+			Creator:  record.Creator,
+			Private:  record.Private,
+			Invited:  record.Invited,
+			Roles:    record.Roles,
+			Banned:   record.Banned,
+			Muted:    record.Muted,
+			AuditLog: record.AuditLog,
+
+			Topic:       record.Topic,
+			Description: record.Description,
+			Created:     record.Created,
+			MaxMembers:  record.MaxMembers,
+			Retention:   record.Retention,
+		}
+		memStore.members[name] = record.UserIDs
+		if memStore.members[name] == nil {
+			memStore.members[name] = make(map[UUID]bool)
+		}
+		memStore.messages[name] = record.Messages
+	}
+	if snapshot.Directs != nil {
+		memStore.directs = snapshot.Directs
+	}
+
+	return snapshot.Checkpoint, nil
+}
+
+// Gob encode a value to a file. The data is written to a temporary file which
+// then replaces the target so a crash mid-write cannot corrupt the old file.
+func writeGobFile(filePath string, value interface{}) error {
+	// create/truncate temporary file for writing to
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
 
-	// decode file contents to store map
-	decoder := gob.NewDecoder(file)
-	err = decoder.Decode(&users)
+	// encode value to file and flush to disk
+	err = gob.NewEncoder(file).Encode(value)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	return nil
+	return os.Rename(tmpPath, filePath)
+}
+
+// Gob decode a file into a value.
+func readGobFile(filePath string, value interface{}) error {
+	// open file to read from
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// decode file contents to value
+	return gob.NewDecoder(file).Decode(value)
 }
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// A server holding its state in a memory store which is journaled to a
+// temporary directory, so it can be restarted to check requests replay.
+type testServer struct {
+	t       *testing.T
+	dataDir string
+}
+
+// Start a new server in a temporary working directory.
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	useTestTokenKey(t)
+
+	// snapshots are written relative to the working directory
+	dir := t.TempDir()
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(workingDir) })
+
+	s := &testServer{t: t, dataDir: dir + "/data"}
+	if err := os.Mkdir(s.dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.start()
+	t.Cleanup(s.stop)
+	return s
+}
+
+// Recover the server state from the snapshot and journal.
+func (s *testServer) start() {
+	s.t.Helper()
+	memStore := newMemoryStore()
+	store = memStore
+	sessions = make(map[UUID]map[*session]bool)
+	if err := recoverMemoryStore(memStore, s.dataDir); err != nil {
+		s.t.Fatalf("recovering server state: %s", err)
+	}
+	resetPresence()
+}
+
+// Close the server's journal.
+func (s *testServer) stop() {
+	if activeJournal != nil {
+		activeJournal.Close()
+		activeJournal = nil
+	}
+}
+
+// Stop the server, dropping all connections, and start it again.
+func (s *testServer) restart() {
+	s.t.Helper()
+	s.stop()
+	s.start()
+}
+
+// A client connection to a test server.
+type testClient struct {
+	t       *testing.T
+	session *session
+	out     chan string
+}
+
+// Connect a client to the test server.
+func connectTestClient(t *testing.T) *testClient {
+	out := make(chan string, 1000)
+	return &testClient{t: t, session: newSession(out), out: out}
+}
+
+// Connect a client and create a user with it.
+func connectTestUser(t *testing.T, userID UUID, name string) *testClient {
+	t.Helper()
+	c := connectTestClient(t)
+	c.mustRequest(Message{Type: "set_name", TargetUUID: userID, Text: name, Secret: "password"})
+	return c
+}
+
+// Process a request from the client and get the responses it has been sent
+// since its last request.
+func (c *testClient) request(msg Message) []Message {
+	c.t.Helper()
+	req := MessageRequest{msg: &msg, out: c.out, session: c.session, creds: prepareCredentials(&msg)}
+	req.processRequest()
+	return c.received()
+}
+
+// Process a request from the client, failing the test if the response to it
+// is an error. The response is returned.
+func (c *testClient) mustRequest(msg Message) Message {
+	c.t.Helper()
+	for _, resp := range c.request(msg) {
+		if resp.Type != msg.Type {
+			continue
+		}
+		if resp.Error != "" {
+			c.t.Fatalf("%s request failed: %s", msg.Type, resp.Error)
+		}
+		return resp
+	}
+	c.t.Fatalf("no response to %s request", msg.Type)
+	return Message{}
+}
+
+// Get the error of the response to a request from the client.
+func (c *testClient) requestError(msg Message) string {
+	c.t.Helper()
+	for _, resp := range c.request(msg) {
+		if resp.Type == msg.Type {
+			return resp.Error
+		}
+	}
+	c.t.Fatalf("no response to %s request", msg.Type)
+	return ""
+}
+
+// Get all messages sent to the client which it has not yet read.
+func (c *testClient) received() []Message {
+	c.t.Helper()
+	var msgs []Message
+	for {
+		select {
+		case str := <-c.out:
+			var msg Message
+			if err := json.Unmarshal([]byte(str), &msg); err != nil {
+				c.t.Fatalf("malformed response '%s': %s", str, err)
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// All persisted server state.
+type serverState struct {
+	Users    map[UUID]*user
+	Rooms    map[string]*room
+	Members  map[string]map[UUID]bool
+	Messages map[string][]Message
+	Directs  map[string][]Message
+}
+
+// Capture the state of the server's memory store. Whether users are online
+// depends on connections rather than requests so is left out, as are rooms
+// without messages. The state is passed through gob so empty & nil maps and
+// slices compare as equal.
+func captureState(t *testing.T) serverState {
+	t.Helper()
+	memStore := store.(*memoryStore)
+	state := serverState{Users: make(map[UUID]*user), Rooms: memStore.rooms, Members: memStore.members, Messages: make(map[string][]Message), Directs: memStore.directs}
+	for id, u := range memStore.users {
+		offline := *u
+		offline.Online = false
+		state.Users[id] = &offline
+	}
+	for name, msgs := range memStore.messages {
+		if len(msgs) > 0 {
+			state.Messages[name] = msgs
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		t.Fatal(err)
+	}
+	var decoded serverState
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// Check that two captured server states match, reporting what differs.
+func compareStates(t *testing.T, expected serverState, actual serverState) {
+	t.Helper()
+	for id, u := range expected.Users {
+		if reflect.DeepEqual(u, actual.Users[id]) == false {
+			t.Errorf("user '%s' differs:\nexpected %+v\ngot      %+v", id, u, actual.Users[id])
+		}
+	}
+	for name, r := range expected.Rooms {
+		if reflect.DeepEqual(r, actual.Rooms[name]) == false {
+			t.Errorf("room '%s' differs:\nexpected %+v\ngot      %+v", name, r, actual.Rooms[name])
+		}
+	}
+	for name, msgs := range expected.Messages {
+		if reflect.DeepEqual(msgs, actual.Messages[name]) == false {
+			t.Errorf("messages of room '%s' differ:\nexpected %+v\ngot      %+v", name, msgs, actual.Messages[name])
+		}
+	}
+	if reflect.DeepEqual(expected.Members, actual.Members) == false {
+		t.Errorf("room members differ:\nexpected %v\ngot      %v", expected.Members, actual.Members)
+	}
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Error("server state differs after restart")
+	}
+}
+
+// Build up state with a range of requests: rooms, roles, moderation, edits,
+// reactions, read markers and messages held for a disconnected user.
+func populateTestServer(t *testing.T) (alice *testClient, ids []UUID) {
+	alice = connectTestUser(t, "alice-id", "alice")
+	bob := connectTestUser(t, "bob-id", "bob")
+	carol := connectTestUser(t, "carol-id", "carol")
+	dave := connectTestUser(t, "dave-id", "dave")
+
+	alice.mustRequest(Message{Type: "create", Room: "general"})
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.mustRequest(Message{Type: "join", Room: "general"})
+	}
+	alice.mustRequest(Message{Type: "grant_role", Room: "general", Target: "bob", Role: RoleModerator})
+	alice.mustRequest(Message{Type: "grant_role", Room: "general", Target: "dave", Role: RoleReadOnly})
+	bob.mustRequest(Message{Type: "mute", Room: "general", Target: "carol", Text: "spam"})
+
+	// messages are held for dave while he is disconnected
+	dave.request(Message{Type: "exit"})
+	for i := 1; i <= 5; i++ {
+		msg := alice.mustRequest(Message{Type: "new_msg", Room: "general", Text: "message " + strconv.Itoa(i)})
+		ids = append(ids, msg.ID)
+	}
+	alice.mustRequest(Message{Type: "edit_msg", Room: "general", ID: ids[0], Text: "edited"})
+	bob.mustRequest(Message{Type: "react", Room: "general", ID: ids[1], Emoji: "+1"})
+	bob.mustRequest(Message{Type: "mark_read", Room: "general", ID: ids[2]})
+
+	return alice, ids
+}
+
+func TestReplayRestoresState(t *testing.T) {
+	srv := startTestServer(t)
+	populateTestServer(t)
+	before := captureState(t)
+
+	srv.restart()
+	compareStates(t, before, captureState(t))
+
+	// read markers set by message ID are kept
+	bob := connectTestClient(t)
+	resp := bob.mustRequest(Message{Type: "list", Token: issueToken("bob-id"), Filter: ListJoined})
+	if len(resp.Rooms) != 1 || resp.Rooms[0].Unread != 2 {
+		t.Errorf("expected 2 unread messages for bob after restart, got %+v", resp.Rooms)
+	}
+
+	// moderation & roles are kept
+	carol := connectTestClient(t)
+	if err := carol.requestError(Message{Type: "new_msg", Room: "general", Token: issueToken("carol-id"), Text: "hello"}); err == "" {
+		t.Error("expected carol to still be muted after restart")
+	}
+	dave := connectTestClient(t)
+	dave.request(Message{Type: "list", Token: issueToken("dave-id")})
+	if err := dave.requestError(Message{Type: "new_msg", Room: "general", Text: "hello"}); err == "" {
+		t.Error("expected dave to still be read only after restart")
+	}
+}
+
+func TestSnapshotRestoresState(t *testing.T) {
+	srv := startTestServer(t)
+	alice, _ := populateTestServer(t)
+	compactJournal()
+
+	// requests after the snapshot are replayed on top of it
+	alice.mustRequest(Message{Type: "set_topic", Room: "general", Text: "after the snapshot"})
+	before := captureState(t)
+
+	srv.restart()
+	compareStates(t, before, captureState(t))
+}
+
+func TestReplayDeliversPendingMessages(t *testing.T) {
+	srv := startTestServer(t)
+	populateTestServer(t)
+	srv.restart()
+
+	// dave receives the messages held for him once he reconnects, only once
+	dave := connectTestClient(t)
+	msgs := dave.request(Message{Type: "list", Token: issueToken("dave-id")})
+	held := 0
+	for _, msg := range msgs {
+		if msg.Type == "new_msg" {
+			held++
+		}
+	}
+	if held != 5 {
+		t.Errorf("expected 5 held messages for dave, got %d", held)
+	}
+
+	srv.restart()
+	if u, _ := store.User("dave-id"); len(u.Pending) != 0 {
+		t.Errorf("expected delivered messages to no longer be held, got %d", len(u.Pending))
+	}
+}
+
+func TestExampleRoomsNotRecreated(t *testing.T) {
+	srv := startTestServer(t)
+	admin := connectTestUser(t, "admin", "admin")
+	admin.mustRequest(Message{Type: "join", Room: "room_1"})
+	admin.mustRequest(Message{Type: "destroy", Room: "room_1"})
+
+	srv.restart()
+	if RoomExists("room_1") {
+		t.Error("expected a destroyed example room to stay destroyed after replay")
+	}
+	compactJournal()
+	srv.restart()
+	if RoomExists("room_1") {
+		t.Error("expected a destroyed example room to stay destroyed after a snapshot")
+	}
+	if RoomExists("room_2") == false {
+		t.Error("expected the other example room to be restored")
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	srv := startTestServer(t)
+	alice, ids := populateTestServer(t)
+
+	// collect the IDs of the messages on a page
+	pageIDs := func(c *testClient, msg Message) []UUID {
+		t.Helper()
+		var page []UUID
+		for _, m := range c.mustRequest(msg).Messages {
+			if m.Type == "new_msg" {
+				page = append(page, m.ID)
+			}
+		}
+		return page
+	}
+
+	latest := pageIDs(alice, Message{Type: "history", Room: "general", Limit: 2})
+	if reflect.DeepEqual(latest, ids[3:]) == false {
+		t.Errorf("expected the latest page to hold the last 2 messages, got %v", latest)
+	}
+	earlier := pageIDs(alice, Message{Type: "history", Room: "general", Limit: 2, Before: string(ids[3])})
+	if reflect.DeepEqual(earlier, ids[1:3]) == false {
+		t.Errorf("expected the page before message 4 to hold messages 2 & 3, got %v", earlier)
+	}
+	later := pageIDs(alice, Message{Type: "history", Room: "general", Limit: 2, After: string(ids[0])})
+	if reflect.DeepEqual(later, ids[1:3]) == false {
+		t.Errorf("expected the page after message 1 to hold messages 2 & 3, got %v", later)
+	}
+
+	// pages are the same once the messages are restored from the journal
+	srv.restart()
+	alice = connectTestClient(t)
+	alice.request(Message{Type: "list", Token: issueToken("alice-id")})
+	restored := pageIDs(alice, Message{Type: "history", Room: "general", Limit: 2, Before: string(ids[3])})
+	if reflect.DeepEqual(restored, earlier) == false {
+		t.Errorf("expected the same page after restart, got %v", restored)
+	}
+}
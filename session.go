@@ -0,0 +1,55 @@
+package main
+
+// All authenticated client sessions (key is UUID, value is set of sessions).
+var sessions = make(map[UUID]map[*session]bool)
+
+// A client connection. The connection's identity is established once by
+// its handshake (set_name, login or a token) and cannot change afterwards.
+type session struct {
+	userID        UUID
+	authenticated bool
+	out           chan string
+
+	// connectionless sessions expire when idle as no disconnect is seen
+	connectionless bool
+}
+
+// Create a session for a connection writing to the specified output channel.
+func newSession(out chan string) *session {
+	return &session{out: out}
+}
+
+// Bind a user identity to the session and register it as one of the user's
+// sessions. The user comes online with their first session.
+func (s *session) bind(userID UUID) {
+	s.userID = userID
+	s.authenticated = true
+
+	if sessions[userID] == nil {
+		sessions[userID] = make(map[*session]bool)
+	}
+	sessions[userID][s] = true
+	setOnline(userID, true)
+}
+
+// Unregister a dropped session. The user goes offline along with their last
+// session.
+func (s *session) unbind() {
+	if s.authenticated == false {
+		return
+	}
+	s.authenticated = false
+
+	delete(sessions[s.userID], s)
+	if len(sessions[s.userID]) == 0 {
+		delete(sessions, s.userID)
+		setOnline(s.userID, false)
+	}
+}
+
+// Send a message to every session of a user.
+func sendToUser(userID UUID, msg Message) {
+	for s := range sessions[userID] {
+		msg.marshalRequestToChan(s.out)
+	}
+}
@@ -1,7 +1,22 @@
 var hostname = location.protocol + '//' + location.host;
+var historyPageSize = 50;
+var threadPageSize = 200;
+var typingRefreshMillis = 2000;
+var readMarkerDelayMillis = 1000;
 var msgMe, msgOther, roomBtn, clientUsername;
 var roomsHistory = {};
+var roomsOldestID = {};
+var seenMessageIDs = {};
+var threadsHistory = {};
+var unreadMentions = [];
+var showMentions = false;
+var roomsUnread = {};
+var roomsTopic = {};
+var typingUsers = {};
+var lastTypingSent = 0;
+var pendingReadMarkers = {};
 var currentRoom = null;
+var currentThread = null;
 
 $(document).ready(function() {
     // fetch html for room buttons & self/other client messages
@@ -19,14 +34,11 @@ $(document).ready(function() {
         $("#msg-input").attr("placeholder", clientUsername + ", type your message here...");
     });
     
-    // wait for required html to be fetched before refreshing
+    // wait for required html to be fetched before streaming chat data
     setTimeout(function() {
-        mainWaitLoop();    
+        connectEventStream();
     }, 500);
     
-    // fetch room names & add to side bar
-    performRequest(hostname + "/request/", "POST", {Type: "list"}, function(rooms) {});
-    
     // send message on button click
     $("#input-pane button").on("click", function(e) {
         sendMessage();
@@ -37,18 +49,27 @@ $(document).ready(function() {
             sendMessage();
         }
     });
+    // let other room members know the client is typing
+    $("#msg-input").on("input", function(e) {
+        notifyTyping();
+    });
+
+    // list only rooms with names starting with the search text
+    $("#room-search").on("input", function(e) {
+        requestRoomList();
+    });
     
     // handle room control button actions
     $(".room-control-btn").on("click", function(e) {
         switch ($(this).attr("id")) {
             // refresh room list
             case "refresh-btn":
-                performRequest(hostname + "/request/", "POST", {Type: "list"}, function(rooms) {});
+                requestRoomList();
                 break;
             // join a room
             case "join-btn":
                 var roomName = prompt("Enter the name of the room to join:", "");
-                performRequest(hostname + "/request/", "POST", {Type: "join", Room: roomName}, function(rooms) {});
+                performRequest(hostname + "/request/", "POST", {Type: "join", Room: roomName, Limit: historyPageSize}, function(rooms) {});
                 break;
             // leave a room
             case "leave-btn":
@@ -58,7 +79,63 @@ $(document).ready(function() {
             // create a room
             case "create-btn":
                 var roomName = prompt("Enter the name of the room to create:", "");
-                performRequest(hostname + "/request/", "POST", {Type: "create", Room: roomName}, function(rooms) {});
+                if (roomName) {
+                    var isPrivate = confirm("Make the room private? Private rooms are hidden from everyone you have not invited.");
+                    performRequest(hostname + "/request/", "POST", {Type: "create", Room: roomName, Private: isPrivate}, function(rooms) {});
+                }
+                break;
+            // invite a user to a room
+            case "invite-btn":
+                var userName = prompt("Enter the name of the user to invite to " + currentRoom + ":", "");
+                if (userName) {
+                    performRequest(hostname + "/request/", "POST", {Type: "invite", Room: currentRoom, Target: userName}, function(rooms) {});
+                }
+                break;
+            // open a direct message conversation
+            case "dm-btn":
+                var userName = prompt("Enter the name of the user to message:", "");
+                if (userName) {
+                    openConversation(userName);
+                }
+                break;
+            // view & mark unread mentions as read
+            case "mentions-btn":
+                showMentions = true;
+                performRequest(hostname + "/request/", "POST", {Type: "mentions"}, function(rooms) {});
+                break;
+            // kick, ban or mute a user in the current room, or view its audit log
+            case "moderate-btn":
+                var action = prompt("Enter a moderation action for " + currentRoom + " (kick, ban, unban, mute, unmute or audit):", "");
+                if (action === "audit") {
+                    performRequest(hostname + "/request/", "POST", {Type: "audit", Room: currentRoom}, function(rooms) {});
+                    break;
+                }
+                if (["kick", "ban", "unban", "mute", "unmute"].indexOf(action) === -1) {
+                    break;
+                }
+                var userName = prompt("Enter the name of the user to " + action + ":", "");
+                if (!userName) {
+                    break;
+                }
+                var request = {Type: action, Room: currentRoom, Target: userName};
+                if (action === "ban" || action === "mute") {
+                    request.Duration = prompt("Enter a duration such as 30m or 24h, or leave empty for no expiry:", "");
+                }
+                if (action === "kick" || action === "ban" || action === "mute") {
+                    request.Text = prompt("Enter a reason (optional):", "");
+                }
+                performRequest(hostname + "/request/", "POST", request, function(rooms) {});
+                break;
+            // set the topic of the current room
+            case "topic-btn":
+                var topic = prompt("Enter the topic of " + currentRoom + ", or leave empty to clear it:", roomsTopic[currentRoom] || "");
+                if (topic !== null) {
+                    performRequest(hostname + "/request/", "POST", {Type: "set_topic", Room: currentRoom, Text: topic}, function(rooms) {});
+                }
+                break;
+            // show the information & settings of the current room
+            case "info-btn":
+                performRequest(hostname + "/request/", "POST", {Type: "room_info", Room: currentRoom}, function(rooms) {});
                 break;
             // destroy a room
             case "destroy-btn":
@@ -80,92 +157,607 @@ $(document).ready(function() {
     });
 });
 
-// Continuously retrieve new chat data.
-function mainWaitLoop() {
-    // poll for new chat data
-    setInterval(function() {
-        // update message window with currently selected room's data feed
-        if (currentRoom != null) {
-            $("#messages-pane").empty().append(roomsHistory[currentRoom]);
-        }
-        
+// Stream new chat data from the server. The browser reconnects automatically
+// and resumes from the last received event via the Last-Event-ID header. A new
+// stream only receives responses to requests made once it is open.
+function connectEventStream() {
+    var eventSource = new EventSource(hostname + "/events/");
+    eventSource.onopen = function(e) {
         // fetch room names & add to side bar
-        performRequest(hostname + "/refresh/", "GET", "", function(response) {
-            if (response.trim() !== "") {
-                // parse response as json
-                var jsonResponse = JSON.parse(response);
-
-                // init room data to string if null
-                if (roomsHistory[jsonResponse.Room] == null) {
-                    roomsHistory[jsonResponse.Room] = "";
-                }
-                
-                switch (jsonResponse.Type) {
-                    case "list":
-                        $('#chat-rooms').empty();
-                        var rooms = jsonResponse.Text.split(", ");
-                        rooms.sort();
-                        // iterate over chat room names and append to page
-                        for (var room in rooms) {
-                            var roomBtnPopulated = roomBtn.replace("name_placeholder", rooms[room]);
-                            $('#chat-rooms').append(roomBtnPopulated);
-                            // make button clickable
-                            $(".room-btn").on("click", function(e) {
-                                e.preventDefault();
-                                currentRoom = $(this).html();
-                                $(".well").css("background-color", "#ADB6B5");
-                                $(this).closest(".well").css("background-color", "#909393");
-                            });
-                        }
-
-                    case "new_msg":
-                    case "join":
-                    case "leave":
-                        logChatMessage(jsonResponse);
-                        break;
-                    case "create":
-                    case "destroy":
-                        logChatMessage(jsonResponse);
-                        // fetch room names & add to side bar
-                        setTimeout(function() {
-                            performRequest(hostname + "/request/", "POST", {Type: "list"}, function(rooms) {});
-                        }, 500);
-                        
-                        break;
-
-                    default:
-                        console.log("Unrecognised response type: " + jsonResponse.Type);
+        requestRoomList();
+        // fetch unread mentions count
+        performRequest(hostname + "/request/", "POST", {Type: "mentions"}, function(rooms) {});
+    };
+    eventSource.onmessage = function(e) {
+        if (e.data.trim() !== "") {
+            handleResponse(JSON.parse(e.data));
+        }
+    };
+    eventSource.onerror = function(e) {
+        console.log("Event stream disconnected, reconnecting...");
+    };
+}
+
+// Update the page with a server response.
+function handleResponse(jsonResponse) {
+    // init room data to string if null
+    if (roomsHistory[jsonResponse.Room] == null) {
+        roomsHistory[jsonResponse.Room] = "";
+    }
+
+    switch (jsonResponse.Type) {
+        case "list":
+            if (jsonResponse.Error !== "") {
+                console.log(jsonResponse.Error);
+                break;
+            }
+            $('#chat-rooms').empty();
+            var rooms = jsonResponse.Rooms || [];
+            // append a button for each listed chat room
+            for (var i in rooms) {
+                var roomBtnPopulated = $(roomBtn);
+                roomBtnPopulated.find(".room-btn").text(rooms[i].Name);
+                if (rooms[i].Private) {
+                    roomBtnPopulated.addClass("private-room");
+                }
+                $('#chat-rooms').append(roomBtnPopulated);
+                roomsTopic[rooms[i].Name] = rooms[i].Topic;
+                if (rooms[i].Joined) {
+                    roomsUnread[rooms[i].Name] = rooms[i].Unread;
+                } else {
+                    delete roomsUnread[rooms[i].Name];
+                }
+                if (rooms[i].Name === currentRoom) {
+                    roomBtnPopulated.css("background-color", "#909393");
+                }
+            }
+            // make buttons clickable
+            $("#chat-rooms .room-btn").on("click", function(e) {
+                e.preventDefault();
+                currentRoom = $(this).text();
+                currentThread = null;
+                $(".well").css("background-color", "#ADB6B5");
+                $(this).closest(".well").css("background-color", "#909393");
+                markRead(currentRoom, 0);
+                // fetch recent messages of rooms joined before the page was loaded
+                if (roomsOldestID[currentRoom] === undefined) {
+                    performRequest(hostname + "/request/", "POST", {Type: "history", Room: currentRoom, Limit: historyPageSize}, function(rooms) {});
+                }
+                renderCurrentRoom();
+            });
+            break;
+
+        case "new_msg":
+            // messages in the room being viewed are read straight away
+            if (jsonResponse.Error === "" && jsonResponse.Username !== clientUsername) {
+                if (jsonResponse.Room === currentRoom) {
+                    markRead(jsonResponse.Room, jsonResponse.Seq);
+                } else if (roomsUnread[jsonResponse.Room] != null) {
+                    roomsUnread[jsonResponse.Room]++;
                 }
             }
+            // replies are shown in their thread rather than the room
+            if (jsonResponse.ParentID) {
+                logThreadReply(jsonResponse);
+                break;
+            }
+        case "join":
+        case "leave":
+            logChatMessage(jsonResponse);
+            break;
+        case "thread":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse);
+                break;
+            }
+            threadsHistory[jsonResponse.ID] = "";
+            for (var i in jsonResponse.Messages) {
+                threadsHistory[jsonResponse.ID] += renderChatMessage(jsonResponse.Messages[i], true);
+            }
+            currentRoom = jsonResponse.Room;
+            currentThread = jsonResponse.ID;
+            break;
+        case "dm":
+            // file direct messages under the other user's conversation
+            var otherUser = jsonResponse.Username === clientUsername ? jsonResponse.Target : jsonResponse.Username;
+            if (jsonResponse.Error === "") {
+                addConversationButton(otherUser);
+            }
+            logChatMessage(jsonResponse, "@" + otherUser);
+            break;
+        case "dm_history":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse, currentRoom);
+                break;
+            }
+            roomsHistory["@" + jsonResponse.Target] = "";
+            for (var i in jsonResponse.Messages) {
+                logChatMessage(jsonResponse.Messages[i], "@" + jsonResponse.Target);
+            }
+            break;
+        case "history":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse);
+                break;
+            }
+            // older messages are placed above those already logged, skipping
+            // any which were received before the page was requested
+            var pageHTML = "";
+            for (var i in jsonResponse.Messages) {
+                if (!seenMessageIDs[jsonResponse.Messages[i].ID]) {
+                    pageHTML += renderChatMessage(jsonResponse.Messages[i]);
+                }
+            }
+            roomsHistory[jsonResponse.Room] = pageHTML + roomsHistory[jsonResponse.Room];
+            if (jsonResponse.Messages.length > 0) {
+                roomsOldestID[jsonResponse.Room] = jsonResponse.Messages[0].ID;
+            } else {
+                roomsOldestID[jsonResponse.Room] = null;
+            }
+            break;
+        case "edit_msg":
+        case "delete_msg":
+        case "react":
+        case "unreact":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse);
+                break;
+            }
+            // re-render the modified message in place in the room & its thread
+            roomsHistory[jsonResponse.Room] = updateLoggedMessage(roomsHistory[jsonResponse.Room], jsonResponse, false);
+            var threadID = jsonResponse.ParentID || jsonResponse.ID;
+            if (threadsHistory[threadID] != null) {
+                threadsHistory[threadID] = updateLoggedMessage(threadsHistory[threadID], jsonResponse, true);
+            }
+            break;
+        case "mark_read":
+            // update the unread count with the client's new read position
+            if (jsonResponse.Error === "" && jsonResponse.Unread) {
+                roomsUnread[jsonResponse.Room] = jsonResponse.Unread[jsonResponse.Room];
+            }
+            break;
+        case "typing":
+            if (typingUsers[jsonResponse.Room] == null) {
+                typingUsers[jsonResponse.Room] = {};
+            }
+            if (jsonResponse.Status === "typing") {
+                typingUsers[jsonResponse.Room][jsonResponse.Username] = true;
+            } else {
+                delete typingUsers[jsonResponse.Room][jsonResponse.Username];
+            }
+            break;
+        case "mention":
+            unreadMentions.push(jsonResponse);
+            updateMentionsCount();
+            break;
+        case "mentions":
+            unreadMentions = jsonResponse.Messages || [];
+            updateMentionsCount();
+            if (!showMentions) {
+                break;
+            }
+            // list the mentions in the message pane, then mark them as read
+            showMentions = false;
+            roomsHistory["!mentions"] = "";
+            for (var i in unreadMentions) {
+                var mention = $.extend({}, unreadMentions[i], {Username: unreadMentions[i].Username + " in " + unreadMentions[i].Room});
+                roomsHistory["!mentions"] += renderChatMessage(mention);
+            }
+            if (unreadMentions.length === 0) {
+                roomsHistory["!mentions"] = "<p>No unread mentions.</p>";
+            }
+            currentRoom = "!mentions";
+            currentThread = null;
+            performRequest(hostname + "/request/", "POST", {Type: "clear_mentions"}, function(rooms) {});
+            break;
+        case "clear_mentions":
+            unreadMentions = [];
+            updateMentionsCount();
+            break;
+        case "invite":
+            // respond to invitations sent to this user
+            if (jsonResponse.Error === "" && jsonResponse.Target === clientUsername) {
+                var accept = confirm(jsonResponse.Username + " invited you to join the '" + jsonResponse.Room + "' room. Accept the invitation?");
+                var type = accept ? "accept_invite" : "decline_invite";
+                performRequest(hostname + "/request/", "POST", {Type: type, Room: jsonResponse.Room, Limit: historyPageSize}, function(rooms) {});
+                // private rooms are only listed once joined
+                setTimeout(function() {
+                    requestRoomList();
+                }, 500);
+                break;
+            }
+            logChatMessage(jsonResponse);
+            break;
+        case "decline_invite":
+        case "grant_role":
+        case "revoke_role":
+        case "unban":
+        case "mute":
+        case "unmute":
+            logChatMessage(jsonResponse);
+            break;
+        case "kick":
+        case "ban":
+            logChatMessage(jsonResponse);
+            // rooms the client was removed from may no longer be listed
+            if (jsonResponse.Error === "" && jsonResponse.Target === clientUsername) {
+                requestRoomList();
+            }
+            break;
+        case "room_info":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse);
+                break;
+            }
+            var info = jsonResponse.Info;
+            alert(info.Name + (info.Private ? " (private)" : "") +
+                "\nTopic: " + (info.Topic || "none") +
+                "\nDescription: " + (info.Description || "none") +
+                "\nCreated by " + (info.Creator || "server") + " at " + info.Created +
+                "\nMembers: " + info.Members + (info.MaxMembers > 0 ? " of " + info.MaxMembers : "") +
+                "\nMessages kept for: " + (info.Retention || "forever"));
+            break;
+        case "set_topic":
+            if (jsonResponse.Error === "") {
+                roomsTopic[jsonResponse.Room] = jsonResponse.Info.Topic;
+            }
+            logChatMessage(jsonResponse);
+            break;
+        case "set_room_settings":
+            logChatMessage(jsonResponse);
+            break;
+        case "audit":
+            if (jsonResponse.Error !== "") {
+                logChatMessage(jsonResponse);
+                break;
+            }
+            // list the room's moderation actions in the message pane
+            roomsHistory["!audit"] = "";
+            var entries = jsonResponse.Messages || [];
+            for (var i in entries) {
+                roomsHistory["!audit"] += renderChatMessage($.extend({}, entries[i], {Username: entries[i].DateTime}));
+            }
+            if (entries.length === 0) {
+                roomsHistory["!audit"] = "<p>No moderation actions recorded.</p>";
+            }
+            currentRoom = "!audit";
+            currentThread = null;
+            break;
+        case "create":
+        case "destroy":
+            logChatMessage(jsonResponse);
+            // fetch room names & add to side bar
+            setTimeout(function() {
+                requestRoomList();
+            }, 500);
+
+            break;
+
+        default:
+            console.log("Unrecognised response type: " + jsonResponse.Type);
+    }
+
+    renderCurrentRoom();
+    renderUnreadBadges();
+}
+
+// Request the rooms matching the room search text.
+function requestRoomList() {
+    performRequest(hostname + "/request/", "POST", {Type: "list", Text: $("#room-search").val() || ""}, function(rooms) {});
+}
+
+// Show the number of unread messages and the topic on each room button.
+function renderUnreadBadges() {
+    $("#chat-rooms .room-btn").each(function() {
+        var count = roomsUnread[$(this).text()];
+        $(this).siblings(".unread-badge").text(count > 0 ? count : "");
+        $(this).closest(".well").find(".room-topic").text(roomsTopic[$(this).text()] || "");
+    });
+}
+
+// Mark a room's messages as read up to a sequence number, or all of them if
+// zero. Markers are sent after a short delay so a burst of messages is marked
+// read with a single request.
+function markRead(roomName, seq) {
+    var pending = pendingReadMarkers[roomName];
+    if (pending != null) {
+        // a pending marker for all messages already covers any sequence number
+        if (pending !== 0 && (seq === 0 || seq > pending)) {
+            pendingReadMarkers[roomName] = seq;
+        }
+        return;
+    }
+
+    pendingReadMarkers[roomName] = seq;
+    setTimeout(function() {
+        var markerSeq = pendingReadMarkers[roomName];
+        delete pendingReadMarkers[roomName];
+        performRequest(hostname + "/request/", "POST", {Type: "mark_read", Room: roomName, Seq: markerSeq}, function(rooms) {});
+    }, readMarkerDelayMillis);
+}
+
+// Update message window with currently selected room's data feed.
+function renderCurrentRoom() {
+    if (currentRoom != null) {
+        if (currentThread != null) {
+            $("#messages-pane").empty().append(threadsHistory[currentThread]);
+        } else {
+            $("#messages-pane").empty().append(roomsHistory[currentRoom]);
+        }
+
+        // show which room members are typing
+        var typists = Object.keys(typingUsers[currentRoom] || {});
+        if (typists.length > 0) {
+            var typingText = typists.join(", ") + (typists.length === 1 ? " is typing…" : " are typing…");
+            $("#messages-pane").append($('<p id="typing-indicator"></p>').text(typingText));
+        }
+
+        // edit or delete own messages on click
+        $("#messages-pane .chat-msg.own-msg").on("click", function(e) {
+            editMessage($(this).attr("data-id"), $(this).find("p").text());
+        });
+
+        // toggle the client's reaction with an existing emoji
+        $("#messages-pane .reaction-btn").on("click", function(e) {
+            e.preventDefault();
+            e.stopPropagation();
+            var type = $(this).hasClass("own-reaction") ? "unreact" : "react";
+            performRequest(hostname + "/request/", "POST", {Type: type, Room: currentRoom, ID: $(this).closest(".chat-msg").attr("data-id"), Emoji: $(this).attr("data-emoji")}, function(rooms) {});
         });
-    }, 100);
+
+        // react with a new emoji
+        $("#messages-pane .add-reaction-btn").on("click", function(e) {
+            e.preventDefault();
+            e.stopPropagation();
+            var emoji = prompt("Enter an emoji to react with:", "");
+            if (emoji) {
+                performRequest(hostname + "/request/", "POST", {Type: "react", Room: currentRoom, ID: $(this).closest(".chat-msg").attr("data-id"), Emoji: emoji.trim()}, function(rooms) {});
+            }
+        });
+
+        // open a message's thread
+        $("#messages-pane .thread-btn").on("click", function(e) {
+            e.preventDefault();
+            e.stopPropagation();
+            performRequest(hostname + "/request/", "POST", {Type: "thread", Room: currentRoom, ID: $(this).closest(".chat-msg").attr("data-id"), Limit: threadPageSize}, function(rooms) {});
+        });
+
+        // return from a thread to the room
+        if (currentThread != null) {
+            $("#messages-pane").prepend('<a href="#" id="back-to-room-btn">Back to room</a>');
+            $("#back-to-room-btn").on("click", function(e) {
+                e.preventDefault();
+                currentThread = null;
+                renderCurrentRoom();
+            });
+            return;
+        }
+
+        // offer to fetch the page of messages preceding the oldest loaded
+        if (roomsOldestID[currentRoom]) {
+            $("#messages-pane").prepend('<a href="#" id="load-earlier-btn">Load earlier messages</a>');
+            $("#load-earlier-btn").on("click", function(e) {
+                e.preventDefault();
+                performRequest(hostname + "/request/", "POST", {Type: "history", Room: currentRoom, Limit: historyPageSize, Before: roomsOldestID[currentRoom]}, function(rooms) {});
+            });
+        }
+    }
+}
+
+// Notify the current room that the client is typing. The server expires the
+// notification unless it is refreshed, so it is resent periodically while the
+// client keeps typing.
+function notifyTyping() {
+    if (currentRoom == null || currentRoom.charAt(0) === "@" || currentRoom === "!mentions") {
+        return;
+    }
+    var now = Date.now();
+    if ($("#msg-input").val() === "") {
+        if (lastTypingSent !== 0) {
+            performRequest(hostname + "/request/", "POST", {Type: "typing", Room: currentRoom, Status: "stopped"}, function(rooms) {});
+            lastTypingSent = 0;
+        }
+        return;
+    }
+    if (now - lastTypingSent > typingRefreshMillis) {
+        performRequest(hostname + "/request/", "POST", {Type: "typing", Room: currentRoom, Status: "typing"}, function(rooms) {});
+        lastTypingSent = now;
+    }
+}
+
+// Show the number of unread mentions on the mentions button.
+function updateMentionsCount() {
+    $("#mentions-count").text(unreadMentions.length > 0 ? unreadMentions.length : "");
 }
 
 function sendMessage() {
-    if (currentRoom == null) {
+    if (currentRoom == null || currentRoom === "!mentions") {
         alert("Please select a room to the left to send a message to.");
         return
     }
-    performRequest(hostname + "/request/", "POST", {Type: "new_msg", Room: currentRoom, Text: $("#msg-input").val()}, function(rooms) {});
+    // conversations are prefixed with @ to distinguish them from rooms
+    if (currentThread != null) {
+        performRequest(hostname + "/request/", "POST", {Type: "new_msg", Room: currentRoom, ParentID: currentThread, Text: $("#msg-input").val()}, function(rooms) {});
+    } else if (currentRoom.charAt(0) === "@") {
+        performRequest(hostname + "/request/", "POST", {Type: "dm", Target: currentRoom.slice(1), Text: $("#msg-input").val()}, function(rooms) {});
+    } else {
+        performRequest(hostname + "/request/", "POST", {Type: "new_msg", Room: currentRoom, Text: $("#msg-input").val()}, function(rooms) {});
+    }
+    // sending a room message stops the typing notification on the server
+    lastTypingSent = 0;
     $("#msg-input").val("");
 }
 
-// Add new chat message to corresponding array log.
-function logChatMessage(jsonResponse) {
+// Add a direct message conversation to the side bar if not already listed.
+function addConversationButton(userName) {
+    var key = "@" + userName;
+    if (roomsHistory[key] == null) {
+        roomsHistory[key] = "";
+    }
+    var exists = false;
+    $("#dm-list .room-btn").each(function() {
+        if ($(this).text() === key) {
+            exists = true;
+        }
+    });
+    if (exists) {
+        return;
+    }
+
+    var roomBtnPopulated = $(roomBtn);
+    roomBtnPopulated.find(".room-btn").text(key);
+    $("#dm-list").append(roomBtnPopulated);
+    $("#dm-list .room-btn").last().on("click", function(e) {
+        e.preventDefault();
+        selectConversation($(this));
+    });
+}
+
+// Open a direct message conversation & fetch its history.
+function openConversation(userName) {
+    addConversationButton(userName);
+    $("#dm-list .room-btn").each(function() {
+        if ($(this).text() === "@" + userName) {
+            selectConversation($(this));
+        }
+    });
+}
+
+// Select a conversation button & fetch the conversation history.
+function selectConversation(btn) {
+    currentRoom = btn.text();
+    currentThread = null;
+    $(".well").css("background-color", "#ADB6B5");
+    btn.closest(".well").css("background-color", "#909393");
+    performRequest(hostname + "/request/", "POST", {Type: "dm_history", Target: currentRoom.slice(1)}, function(rooms) {});
+    renderCurrentRoom();
+}
+
+// Add new chat message to corresponding array log, keyed by room unless a
+// conversation key is given.
+function logChatMessage(jsonResponse, key) {
+    if (key == null) {
+        key = jsonResponse.Room;
+    }
+    if (roomsHistory[key] == null) {
+        roomsHistory[key] = "";
+    }
+    roomsHistory[key] += renderChatMessage(jsonResponse);
+}
+
+// Add a thread reply to its thread if loaded and count it against the
+// message replied to in the room.
+function logThreadReply(jsonResponse) {
+    if (threadsHistory[jsonResponse.ParentID] != null) {
+        threadsHistory[jsonResponse.ParentID] += renderChatMessage(jsonResponse, true);
+    }
+
+    var roomLog = $("<div>").html(roomsHistory[jsonResponse.Room]);
+    var parent = roomLog.find('.chat-msg[data-id="' + jsonResponse.ParentID + '"]');
+    var replies = (parseInt(parent.attr("data-replies")) || 0) + 1;
+    parent.attr("data-replies", replies);
+    parent.find(".thread-btn").text(threadLabel(replies));
+    roomsHistory[jsonResponse.Room] = roomLog.html();
+}
+
+// Re-render a modified message within a logged room or thread, keeping its
+// reply count.
+function updateLoggedMessage(logHTML, jsonResponse, inThread) {
+    var log = $("<div>").html(logHTML);
+    var existing = log.find('.chat-msg[data-id="' + jsonResponse.ID + '"]');
+    jsonResponse.Replies = parseInt(existing.attr("data-replies")) || 0;
+    existing.replaceWith(renderChatMessage(jsonResponse, inThread));
+    return log.html();
+}
+
+// Get the label of the link to a message's thread.
+function threadLabel(replies) {
+    if (replies === 1) {
+        return "1 reply";
+    }
+    if (replies > 1) {
+        return replies + " replies";
+    }
+    return "Reply";
+}
+
+// Build the html for a chat message. Messages in the room log link to their
+// thread. Every field of the message may come from another user, so all are
+// set as text or attribute values rather than markup.
+function renderChatMessage(jsonResponse, inThread) {
+    if (jsonResponse.ID) {
+        seenMessageIDs[jsonResponse.ID] = true;
+    }
     var targetTemplate = msgOther;
     if (jsonResponse.Username === clientUsername) {
         targetTemplate = msgMe;
     }
     // check for error
-    var message = jsonResponse.Text;
+    var message = $("<span>").text(jsonResponse.Text);
+    var name = jsonResponse.Username;
     if (jsonResponse.Error !== "") {
-        message = jsonResponse.Error.charAt(0).toUpperCase() + jsonResponse.Error.slice(1);
+        message.text(jsonResponse.Error.charAt(0).toUpperCase() + jsonResponse.Error.slice(1));
+    } else if (jsonResponse.Deleted) {
+        message = $("<em>").text("This message was deleted.");
+    } else if (jsonResponse.Revisions && jsonResponse.Revisions.length > 0) {
+        name += " (edited)";
     }
     
-    // replace template variables with message data
-    var msgHTMLPopulated = targetTemplate.replace("name_placeholder", jsonResponse.Username);
-    msgHTMLPopulated = msgHTMLPopulated.replace("message_placeholder", message);
-    roomsHistory[jsonResponse.Room] += msgHTMLPopulated;
+    // fill the template with message data
+    var msgPopulated = $("<div>").html(targetTemplate);
+    msgPopulated.find("h4").text(name);
+    msgPopulated.find("p").empty().append(message);
+
+    // wrap stored chat messages so they can be found again when modified
+    var storedTypes = ["new_msg", "edit_msg", "delete_msg", "react", "unreact"];
+    if (jsonResponse.ID && storedTypes.indexOf(jsonResponse.Type) !== -1) {
+        var replies = jsonResponse.Replies || 0;
+        var wrapper = $('<div class="chat-msg"></div>').attr("data-id", jsonResponse.ID).attr("data-replies", replies);
+        if (jsonResponse.Username === clientUsername && !jsonResponse.Deleted) {
+            wrapper.addClass("own-msg");
+        }
+        wrapper.append(msgPopulated.contents());
+        if (!jsonResponse.Deleted) {
+            wrapper.append(renderReactions(jsonResponse.Reactions));
+        }
+        if (!inThread) {
+            wrapper.append($('<a href="#" class="thread-btn"></a>').text(threadLabel(replies)));
+        }
+        msgPopulated = $("<div>").append(wrapper);
+    }
+    return msgPopulated.html();
+}
+
+// Build the elements for a message's reaction counts, highlighting those the
+// client has made.
+function renderReactions(reactions) {
+    var container = $('<div class="reactions"></div>');
+    for (var i in reactions) {
+        var btn = $('<a href="#" class="reaction-btn"></a>');
+        if (reactions[i].Users.indexOf(clientUsername) !== -1) {
+            btn.addClass("own-reaction");
+        }
+        btn.attr("data-emoji", reactions[i].Emoji).text(reactions[i].Emoji + " " + reactions[i].Count);
+        container.append(btn);
+    }
+    container.append('<a href="#" class="add-reaction-btn">+</a>');
+    return container;
+}
+
+// Prompt for the new text of one of the client's messages, deleting the
+// message if no text is entered.
+function editMessage(id, currentText) {
+    var text = prompt("Edit your message (leave empty to delete it):", currentText);
+    if (text == null) {
+        return;
+    }
+    if (text.trim() === "") {
+        if (confirm("Are you sure you want to delete this message?")) {
+            performRequest(hostname + "/request/", "POST", {Type: "delete_msg", Room: currentRoom, ID: id}, function(rooms) {});
+        }
+        return;
+    }
+    performRequest(hostname + "/request/", "POST", {Type: "edit_msg", Room: currentRoom, ID: id, Text: text}, function(rooms) {});
 }
 
 // Perform AJAX request.
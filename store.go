@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Supported store backends.
+const (
+	MemoryStore = "memory"
+	BoltStore   = "bolt"
+)
+
+// Storage for rooms, room memberships, users and messages. Records returned
+// by the store must be saved back to it after being modified.
+type Store interface {
+	// rooms
+	Room(name string) (*room, bool)
+	RoomNames() []string
+	SaveRoom(r *room) error
+	DeleteRoom(name string) error
+
+	// room memberships
+	AddMember(roomName string, userID UUID) error
+	RemoveMember(roomName string, userID UUID) error
+	IsMember(roomName string, userID UUID) bool
+	Members(roomName string) []UUID
+
+	// users
+	User(id UUID) (*user, bool)
+	UserIDs() []UUID
+	SaveUser(id UUID, u *user) error
+
+	// room messages, numbered by a per-room sequence as they are appended
+	AppendMessage(roomName string, msg *Message) error
+	UpdateMessage(roomName string, msg Message) error
+	Messages(roomName string) []Message
+
+	// direct messages between pairs of users, numbered per conversation
+	AppendDirectMessage(a UUID, b UUID, msg *Message) error
+	DirectMessages(a UUID, b UUID) []Message
+
+	Close() error
+}
+
+// Open the store backend with the specified name.
+func openStore(backend string, dataDir string) (Store, error) {
+	switch backend {
+	case MemoryStore:
+		return newMemoryStore(), nil
+	case BoltStore:
+		return openBoltStore(dataDir + "/msghub.db")
+	}
+	return nil, fmt.Errorf("unsupported store backend '%s'", backend)
+}
+
+// Get the key identifying the direct message conversation between two users.
+func directKey(a UUID, b UUID) string {
+	if a > b {
+		a, b = b, a
+	}
+	return string(a) + ":" + string(b)
+}
+
+// A store which holds all data in memory. Durability is provided by the
+// server journal and snapshots.
+type memoryStore struct {
+	rooms    map[string]*room
+	members  map[string]map[UUID]bool
+	messages map[string][]Message
+	directs  map[string][]Message
+	users    map[UUID]*user
+}
+
+// Create an empty in-memory store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		rooms:    make(map[string]*room),
+		members:  make(map[string]map[UUID]bool),
+		messages: make(map[string][]Message),
+		directs:  make(map[string][]Message),
+		users:    make(map[UUID]*user),
+	}
+}
+
+func (s *memoryStore) Room(name string) (*room, bool) {
+	r, ok := s.rooms[name]
+	return r, ok
+}
+
+func (s *memoryStore) RoomNames() []string {
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *memoryStore) SaveRoom(r *room) error {
+	s.rooms[r.Name] = r
+	if s.members[r.Name] == nil {
+		s.members[r.Name] = make(map[UUID]bool)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteRoom(name string) error {
+	delete(s.rooms, name)
+	delete(s.members, name)
+	delete(s.messages, name)
+	return nil
+}
+
+func (s *memoryStore) AddMember(roomName string, userID UUID) error {
+	if _, ok := s.rooms[roomName]; !ok {
+		return fmt.Errorf("room '%s' does not exist", roomName)
+	}
+	s.members[roomName][userID] = true
+	return nil
+}
+
+func (s *memoryStore) RemoveMember(roomName string, userID UUID) error {
+	delete(s.members[roomName], userID)
+	return nil
+}
+
+func (s *memoryStore) IsMember(roomName string, userID UUID) bool {
+	return s.members[roomName][userID]
+}
+
+func (s *memoryStore) Members(roomName string) []UUID {
+	ids := make([]UUID, 0, len(s.members[roomName]))
+	for id := range s.members[roomName] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *memoryStore) User(id UUID) (*user, bool) {
+	u, ok := s.users[id]
+	return u, ok
+}
+
+func (s *memoryStore) UserIDs() []UUID {
+	ids := make([]UUID, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *memoryStore) SaveUser(id UUID, u *user) error {
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) AppendMessage(roomName string, msg *Message) error {
+	if _, ok := s.rooms[roomName]; !ok {
+		return fmt.Errorf("room '%s' does not exist", roomName)
+	}
+	msg.Seq = uint64(len(s.messages[roomName])) + 1
+	s.messages[roomName] = append(s.messages[roomName], *msg)
+	return nil
+}
+
+func (s *memoryStore) UpdateMessage(roomName string, msg Message) error {
+	msgs := s.messages[roomName]
+	if msg.Seq == 0 || msg.Seq > uint64(len(msgs)) {
+		return fmt.Errorf("message %d does not exist in room '%s'", msg.Seq, roomName)
+	}
+	msgs[msg.Seq-1] = msg
+	return nil
+}
+
+func (s *memoryStore) Messages(roomName string) []Message {
+	return s.messages[roomName]
+}
+
+func (s *memoryStore) AppendDirectMessage(a UUID, b UUID, msg *Message) error {
+	key := directKey(a, b)
+	msg.Seq = uint64(len(s.directs[key])) + 1
+	s.directs[key] = append(s.directs[key], *msg)
+	return nil
+}
+
+func (s *memoryStore) DirectMessages(a UUID, b UUID) []Message {
+	return s.directs[directKey(a, b)]
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
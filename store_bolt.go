@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top level bolt buckets. The members and messages buckets hold a nested
+// bucket per room and the directs bucket one per conversation.
+var (
+	roomsBucket    = []byte("rooms")
+	membersBucket  = []byte("members")
+	usersBucket    = []byte("users")
+	messagesBucket = []byte("messages")
+	directsBucket  = []byte("directs")
+)
+
+// A store persisting all data to an embedded bolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Open or create a bolt store at the specified path.
+func openBoltStore(filePath string) (*boltStore, error) {
+	db, err := bolt.Open(filePath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	// create top level buckets
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{roomsBucket, membersBucket, usersBucket, messagesBucket, directsBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Room(name string) (*room, bool) {
+	var r *room
+	s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(roomsBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		r = &room{}
+		return json.Unmarshal(data, r)
+	})
+	return r, r != nil
+}
+
+func (s *boltStore) RoomNames() []string {
+	var names []string
+	s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names
+}
+
+func (s *boltStore) SaveRoom(r *room) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).Put([]byte(r.Name), data)
+	})
+}
+
+func (s *boltStore) DeleteRoom(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(roomsBucket).Delete([]byte(name))
+		if err != nil {
+			return err
+		}
+		// remove nested room buckets if they were ever created
+		for _, parent := range [][]byte{membersBucket, messagesBucket} {
+			err = tx.Bucket(parent).DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AddMember(roomName string, userID UUID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(roomsBucket).Get([]byte(roomName)) == nil {
+			return fmt.Errorf("room '%s' does not exist", roomName)
+		}
+		b, err := tx.Bucket(membersBucket).CreateBucketIfNotExists([]byte(roomName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(userID), []byte{})
+	})
+}
+
+func (s *boltStore) RemoveMember(roomName string, userID UUID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(membersBucket).Bucket([]byte(roomName))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(userID))
+	})
+}
+
+func (s *boltStore) IsMember(roomName string, userID UUID) bool {
+	found := false
+	s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(membersBucket).Bucket([]byte(roomName))
+		found = b != nil && b.Get([]byte(userID)) != nil
+		return nil
+	})
+	return found
+}
+
+func (s *boltStore) Members(roomName string) []UUID {
+	var ids []UUID
+	s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(membersBucket).Bucket([]byte(roomName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ids = append(ids, UUID(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+func (s *boltStore) User(id UUID) (*user, bool) {
+	var u *user
+	s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		u = &user{}
+		return json.Unmarshal(data, u)
+	})
+	return u, u != nil
+}
+
+func (s *boltStore) UserIDs() []UUID {
+	var ids []UUID
+	s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			ids = append(ids, UUID(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+func (s *boltStore) SaveUser(id UUID, u *user) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(id), data)
+	})
+}
+
+func (s *boltStore) AppendMessage(roomName string, msg *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(roomsBucket).Get([]byte(roomName)) == nil {
+			return fmt.Errorf("room '%s' does not exist", roomName)
+		}
+		return appendToBucket(tx.Bucket(messagesBucket), roomName, msg)
+	})
+}
+
+func (s *boltStore) UpdateMessage(roomName string, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, msg.Seq)
+		b := tx.Bucket(messagesBucket).Bucket([]byte(roomName))
+		if b == nil || b.Get(key) == nil {
+			return fmt.Errorf("message %d does not exist in room '%s'", msg.Seq, roomName)
+		}
+		return b.Put(key, data)
+	})
+}
+
+func (s *boltStore) Messages(roomName string) []Message {
+	return s.readBucket(messagesBucket, roomName)
+}
+
+func (s *boltStore) AppendDirectMessage(a UUID, b UUID, msg *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return appendToBucket(tx.Bucket(directsBucket), directKey(a, b), msg)
+	})
+}
+
+func (s *boltStore) DirectMessages(a UUID, b UUID) []Message {
+	return s.readBucket(directsBucket, directKey(a, b))
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Append a message to the nested bucket of a parent bucket, creating it if
+// required. The message is numbered with the bucket's next sequence number.
+func appendToBucket(parent *bolt.Bucket, name string, msg *Message) error {
+	b, err := parent.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	// key messages by a big endian sequence number to keep them ordered
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	msg.Seq = seq
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return b.Put(key, data)
+}
+
+// Read all messages in order from the nested bucket of a parent bucket.
+func (s *boltStore) readBucket(parent []byte, name string) []Message {
+	var msgs []Message
+	s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(parent).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var msg Message
+			err := json.Unmarshal(v, &msg)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+	return msgs
+}
+
+// Run a read-only transaction, logging any failure.
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) {
+	err := s.db.View(fn)
+	if err != nil {
+		log.Println("store error: " + err.Error())
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// Typing notifications expire if not refreshed by the client within the
+// timeout. Expiry is checked every sweep interval.
+const (
+	typingTimeout       = 5 * time.Second
+	typingSweepInterval = time.Second
+)
+
+// Typing notification statuses.
+const (
+	StatusTyping  = "typing"
+	StatusStopped = "stopped"
+)
+
+// Users currently typing in each room (key is room name, value is the expiry
+// of each user's typing notification). Typing state is never stored or
+// journaled.
+var typists = make(map[string]map[UUID]time.Time)
+
+// Start or refresh a user's typing notification in a room. Other room members
+// are only notified when the user starts typing.
+func startTyping(roomName string, userID UUID, userName string) {
+	if typists[roomName] == nil {
+		typists[roomName] = make(map[UUID]time.Time)
+	}
+	_, alreadyTyping := typists[roomName][userID]
+	typists[roomName][userID] = time.Now().Add(typingTimeout)
+	if alreadyTyping == false {
+		relayTyping(roomName, userID, userName, StatusTyping)
+	}
+}
+
+// Stop a user's typing notification in a room, if any.
+func stopTyping(roomName string, userID UUID, userName string) {
+	if _, ok := typists[roomName][userID]; !ok {
+		return
+	}
+	delete(typists[roomName], userID)
+	if len(typists[roomName]) == 0 {
+		delete(typists, roomName)
+	}
+	relayTyping(roomName, userID, userName, StatusStopped)
+}
+
+// Stop typing notifications which have not been refreshed in time.
+func expireTyping() {
+	now := time.Now()
+	for roomName, users := range typists {
+		for userID, expiry := range users {
+			if now.Before(expiry) {
+				continue
+			}
+			name := ""
+			if u, ok := store.User(userID); ok {
+				name = u.Name
+			}
+			stopTyping(roomName, userID, name)
+		}
+	}
+}
+
+// Send a typing notification to every member of a room other than the typist.
+func relayTyping(roomName string, userID UUID, userName string, status string) {
+	msg := Message{Type: "typing", Room: roomName, Username: userName, Status: status, DateTime: GetTimestamp()}
+	for _, id := range store.Members(roomName) {
+		if id != userID {
+			sendToUser(id, msg)
+		}
+	}
+}
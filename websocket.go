@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket server type.
+type WSServer Server
+
+// Largest WebSocket message accepted from a client, matching the longest line
+// read from TCP clients. Connections sending larger messages are closed.
+const wsMaxMessageSize = bufio.MaxScanTokenSize
+
+// Upgrades HTTP connections to WebSocket connections. Requests from any origin
+// are accepted so browser clients can be served from elsewhere.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  2048,
+	WriteBufferSize: 2048,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// Start listening for WebSocket connections on the /ws/ path.
+func (s *WSServer) Start(errors chan error) {
+	// start listener
+	listener, err := net.Listen("tcp", s.host+":"+strconv.Itoa(s.port))
+	if err != nil {
+		errors <- fmt.Errorf("cannot create a WebSocket listener on %s:%d", s.host, s.port)
+		return
+	}
+	log.Printf("starting WebSocket server on port %d", s.port)
+
+	// wrap listener to perform TLS handshakes
+	if *useTLS {
+		config, err := serverTLSConfig()
+		if err != nil {
+			listener.Close()
+			errors <- err
+			return
+		}
+		listener = tls.NewListener(listener, config)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/ws/", s.handleConn)
+	httpServer := &http.Server{Handler: router}
+
+	// serve WebSocket upgrade requests
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Print(err)
+		}
+	}()
+
+	<-s.exit
+	httpServer.Close()
+	errors <- nil
+}
+
+// Upgrade a HTTP request and process the WebSocket connection and associated client.
+func (s *WSServer) handleConn(w http.ResponseWriter, req *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageSize)
+
+	// outgoing client messages
+	ch := make(chan string)
+
+	// send any new msg through connection
+	go s.clientWriter(conn, ch)
+
+	// get client address
+	clientAddress := conn.RemoteAddr().String()
+	fmt.Println(clientAddress + " WebSocket client connection established")
+
+	// read JSON messages from connection
+	sess := newSession(ch)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		// unmarshal client string request into Message object
+		msg := Message{}
+		msg.unmarshalRequest(string(data))
+
+		// produce response based on request
+		requestPool <- MessageRequest{msg: &msg, out: ch, session: sess, creds: prepareCredentials(&msg)}
+	}
+
+	// client disconnecting, the exit is always sent as the session is only
+	// read by the request poller
+	fmt.Println(clientAddress + " WebSocket client connection dropped")
+	exitMsg := Message{Type: "exit"}
+	requestPool <- MessageRequest{msg: &exitMsg, session: sess}
+
+	// requests accepted before the exit have been processed, so nothing else writes to the channel
+	close(ch)
+}
+
+// Push new messages from channel to the WebSocket connection.
+func (s *WSServer) clientWriter(conn *websocket.Conn, ch <-chan string) {
+	for msg := range ch {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		if err != nil {
+			log.Println("Error responding to client: " + err.Error())
+		}
+	}
+}
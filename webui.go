@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,14 +17,13 @@ import (
 
 type HTTPServer struct {
 	Server
-	refreshFeed chan string
-	client      *Client
+	events *eventFeed
+	client *Client
 }
 
 // Start listening for HTTP requests.
 func (s *HTTPServer) Start(client *Client) {
 	s.client = client
-	s.refreshFeed = make(chan string)
 
 	workingDir, err := os.Getwd()
 	if err != nil {
@@ -33,8 +33,8 @@ func (s *HTTPServer) Start(client *Client) {
 
 	// define HTTP routes
 	router := mux.NewRouter()
-	// pull new content from channel
-	router.HandleFunc("/refresh/", s.handleRefresh).Methods("GET")
+	// stream server responses as Server-Sent Events
+	router.HandleFunc("/events/", s.handleEvents).Methods("GET")
 	// retrieve client username
 	router.HandleFunc("/fetch/{type}/", s.handleSpecificRequest).Methods("GET")
 	// chat server related requests
@@ -56,20 +56,51 @@ func (s *HTTPServer) Start(client *Client) {
 	}
 }
 
-// Process HTTP client request to pull fresh chat data.
-func (s *HTTPServer) handleRefresh(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Stream server responses to the HTTP client as Server-Sent Events. A new
+// stream starts with the next event published, while a reconnecting client
+// resumes after the event ID sent in Last-Event-ID.
+func (s *HTTPServer) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
 
-	select {
-	case msg := <-s.refreshFeed:
-		_, err := fmt.Fprintf(w, "%s\n", msg)
-		if err != nil {
-			log.Println(err)
+	// determine the last event received by a reconnecting client, new streams
+	// skip past events so a reloaded page does not act on them again
+	lastID := s.events.latestID()
+	if header := req.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.Atoi(header)
+		if err == nil {
+			lastID = id
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis)
+	flusher.Flush()
+
+	for {
+		// write all events the client has not yet received
+		events, wait := s.events.since(lastID)
+		for _, event := range events {
+			_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.id, event.data)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			lastID = event.id
 		}
-	default:
-		_, err := fmt.Fprintf(w, "%s\n", "")
-		if err != nil {
-			log.Println(err)
+		flusher.Flush()
+
+		// block until a new event is published or the client disconnects
+		select {
+		case <-wait:
+		case <-req.Context().Done():
+			return
 		}
 	}
 }
@@ -80,7 +111,18 @@ func (s *HTTPServer) handleGeneralRequest(w http.ResponseWriter, req *http.Reque
 
 	// perform server request
 	req.ParseForm()
-	msg := Message{TargetUUID: s.client.clientUUID, Type: req.Form.Get("Type"), Room: req.Form.Get("Room"), Text: req.Form.Get("Text"), DateTime: GetTimestamp()}
+	msg := Message{TargetUUID: s.client.clientUUID, Type: req.Form.Get("Type"), Room: req.Form.Get("Room"), Text: req.Form.Get("Text"), Target: req.Form.Get("Target"), DateTime: GetTimestamp()}
+	msg.Limit, _ = strconv.Atoi(req.Form.Get("Limit"))
+	msg.Before, msg.After = req.Form.Get("Before"), req.Form.Get("After")
+	msg.ID = UUID(req.Form.Get("ID"))
+	msg.ParentID = UUID(req.Form.Get("ParentID"))
+	msg.Emoji = req.Form.Get("Emoji")
+	msg.Status = req.Form.Get("Status")
+	msg.Seq, _ = strconv.ParseUint(req.Form.Get("Seq"), 10, 64)
+	msg.Private = req.Form.Get("Private") == "true"
+	msg.Role = req.Form.Get("Role")
+	msg.Duration = req.Form.Get("Duration")
+	msg.Filter = req.Form.Get("Filter")
 	s.client.writeToConnection(s.client.conn, msg)
 
 	// empty http response
@@ -107,6 +149,68 @@ func (s *HTTPServer) handleSpecificRequest(w http.ResponseWriter, req *http.Requ
 	}
 }
 
+// Time in milliseconds a disconnected event stream waits before reconnecting.
+const sseRetryMillis = 1000
+
+// Maximum number of events retained for reconnecting event streams.
+const eventFeedSize = 1000
+
+// A single server response published to event streams.
+type feedEvent struct {
+	id   int
+	data string
+}
+
+// A bounded history of server responses which event streams read from.
+type eventFeed struct {
+	mu     sync.Mutex
+	events []feedEvent
+	nextID int
+	notify chan struct{}
+}
+
+// Create an empty event feed.
+func newEventFeed() *eventFeed {
+	return &eventFeed{notify: make(chan struct{})}
+}
+
+// Add a server response to the feed and wake all waiting event streams.
+func (f *eventFeed) publish(data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, feedEvent{id: f.nextID, data: data})
+	f.nextID++
+	if len(f.events) > eventFeedSize {
+		f.events = f.events[len(f.events)-eventFeedSize:]
+	}
+
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// Get the ID of the latest event published, or -1 if there are none.
+func (f *eventFeed) latestID() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nextID - 1
+}
+
+// Get all events after the specified ID along with a channel which is closed
+// when the next event is published.
+func (f *eventFeed) since(lastID int) ([]feedEvent, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var events []feedEvent
+	for _, event := range f.events {
+		if event.id > lastID {
+			events = append(events, event)
+		}
+	}
+	return events, f.notify
+}
+
 // Opens the specified URL in the default browser.
 func openBrowser(url string) error {
 	var cmd string